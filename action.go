@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/sirupsen/logrus"
+	"veverse-pixelstreaming-operator/launcherpb"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+const (
+	INSTANCE_ACTION_DRAIN     = "drain"
+	INSTANCE_ACTION_TERMINATE = "terminate"
+	INSTANCE_ACTION_REBOOT    = "reboot"
+	INSTANCE_ACTION_STOP      = "stop"
+	INSTANCE_ACTION_START     = "start"
+)
+
+var (
+	// InstanceActions lists the actions accepted by ExecuteInstanceAction
+	InstanceActions = []string{INSTANCE_ACTION_DRAIN, INSTANCE_ACTION_TERMINATE, INSTANCE_ACTION_REBOOT, INSTANCE_ACTION_STOP, INSTANCE_ACTION_START}
+)
+
+// ExecuteInstanceAction performs the action on the EC2 instances of a single region and records the resulting instance status,
+// the reconcile loop and the admin API both change instances only through it. Source is logged to tell them apart.
+func ExecuteInstanceAction(ctx context.Context, api EC2API, source string, action string, instanceIds []string) (err error) {
+	if len(instanceIds) == 0 {
+		return nil
+	}
+
+	logrus.Infof("%s: %s %s %v", source, action, PSInstancePlural, instanceIds)
+
+	// launchers connected over gRPC are told before their instance is taken away
+	var command *launcherpb.OperatorCommand
+	switch action {
+	case INSTANCE_ACTION_DRAIN:
+		command = &launcherpb.OperatorCommand{Command: &launcherpb.OperatorCommand_Drain{Drain: &launcherpb.Drain{}}}
+	case INSTANCE_ACTION_STOP, INSTANCE_ACTION_TERMINATE:
+		command = &launcherpb.OperatorCommand{Command: &launcherpb.OperatorCommand_Shutdown{Shutdown: &launcherpb.Shutdown{}}}
+	}
+
+	if command != nil {
+		for _, id := range instanceIds {
+			Launchers.SendByInstanceId(id, command)
+		}
+	}
+
+	var (
+		status     string
+		hibernated bool
+	)
+
+	switch action {
+	case INSTANCE_ACTION_DRAIN:
+		status = INSTANCE_STATUS_DRAINING
+	case INSTANCE_ACTION_TERMINATE:
+		err = TerminateInstances(ctx, api, instanceIds)
+		status = INSTANCE_STATUS_DELETED
+	case INSTANCE_ACTION_REBOOT:
+		err = RebootInstances(ctx, api, instanceIds)
+	case INSTANCE_ACTION_STOP:
+		hibernated, err = StopInstances(ctx, api, instanceIds)
+		status = INSTANCE_STATUS_STOPPED
+	case INSTANCE_ACTION_START:
+		err = StartInstances(ctx, api, instanceIds)
+		status = INSTANCE_STATUS_STARTING
+	default:
+		return fmt.Errorf("unknown action %s", action)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to %s: %s @ %s: %v", action, PSInstancePlural, reflect.FunctionName(), err)
+	}
+
+	if status == "" {
+		return nil
+	}
+
+	if action == INSTANCE_ACTION_DRAIN {
+		return DrainInstances(ctx, instanceIds)
+	}
+
+	for _, id := range instanceIds {
+		data := PixelStreamingInstanceMetadata{
+			InstanceId: aws.String(id),
+			Status:     aws.String(status),
+		}
+
+		err = UpdatePixelStreamingInstance(ctx, nil, data)
+		if err != nil {
+			return fmt.Errorf("failed to update instance data: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		}
+	}
+
+	switch action {
+	case INSTANCE_ACTION_STOP:
+		return markInstancesStopped(ctx, instanceIds, hibernated)
+	case INSTANCE_ACTION_START:
+		return markInstancesBooting(ctx, instanceIds)
+	}
+
+	return nil
+}
+
+func RebootInstances(ctx context.Context, api EC2API, instanceIds []string) (err error) {
+	_, err = RebootInstance(ctx, api, &ec2.RebootInstancesInput{InstanceIds: instanceIds})
+	if err != nil {
+		return fmt.Errorf("failed to reboot instances: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+	}
+
+	logrus.Infof("reboot instances: %v", instanceIds)
+
+	return nil
+}
+
+func StartInstances(ctx context.Context, api EC2API, instanceIds []string) (err error) {
+	var (
+		startInstanceOutput *ec2.StartInstancesOutput
+	)
+
+	startInstanceOutput, err = StartInstance(ctx, api, &ec2.StartInstancesInput{InstanceIds: instanceIds})
+	if err != nil {
+		return fmt.Errorf("failed to start instances: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+	}
+
+	logrus.Infof("start instances: %v", startInstanceOutput.StartingInstances)
+
+	return nil
+}
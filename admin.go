@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/exp/slices"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SESSION_END_REASON_ADMIN = "admin"
+
+	ADMIN_LIST_LIMIT     = 100
+	ADMIN_LIST_MAX_LIMIT = 1000
+)
+
+// handleAdminInstances serves GET /admin/instances and POST /admin/instances/{id}/{action}.
+func handleAdminInstances(w http.ResponseWriter, r *http.Request) {
+	parts := adminPathParts(r.URL.Path, "/admin/instances")
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		listAdminInstances(w, r)
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		executeAdminInstanceAction(w, r, parts[0], parts[1])
+	case len(parts) == 0 || len(parts) == 2:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleAdminSessions serves GET /admin/sessions and POST /admin/sessions/{id}/close.
+func handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	parts := adminPathParts(r.URL.Path, "/admin/sessions")
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		listAdminSessions(w, r)
+	case len(parts) == 2 && parts[1] == "close" && r.Method == http.MethodPost:
+		closeAdminSession(w, r, parts[0])
+	case len(parts) == 0 || len(parts) == 2 && parts[1] == "close":
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func listAdminInstances(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	var (
+		filter PixelStreamingInstanceFilter
+		err    error
+	)
+
+	if filter.RegionId, err = uuidParam(values, "regionId"); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.ReleaseId, err = uuidParam(values, "releaseId"); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.Limit, err = limitParam(values); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.InstanceType = stringParam(values, "type")
+	filter.Status = stringParam(values, "status")
+
+	instances, err := ListPixelStreamingInstances(r.Context(), filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusOK, instances)
+}
+
+func executeAdminInstanceAction(w http.ResponseWriter, r *http.Request, rawId string, action string) {
+	id, err := uuid.FromString(rawId)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid instance id")
+		return
+	}
+
+	if !slices.Contains(InstanceActions, action) {
+		writeError(w, http.StatusNotFound, "unknown action")
+		return
+	}
+
+	var deadline time.Duration
+	if value := r.URL.Query().Get("deadline"); value != "" {
+		deadline, err = time.ParseDuration(value)
+		if action != INSTANCE_ACTION_DRAIN || err != nil || deadline <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid deadline")
+			return
+		}
+	}
+
+	ctx := r.Context()
+	instance, regionName, err := GetPixelStreamingInstance(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "instance not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get instance")
+		return
+	}
+
+	if instance.InstanceId == nil || instance.Status != nil && *instance.Status == INSTANCE_STATUS_DELETED {
+		writeError(w, http.StatusConflict, "instance is not running in EC2")
+		return
+	}
+
+	ec2Client, err := NewEC2Client(ctx, regionName)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = ExecuteInstanceAction(ctx, ec2Client, "admin", action, []string{*instance.InstanceId})
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	if deadline > 0 {
+		err = SetDrainDeadline(ctx, id, time.Now().Add(deadline))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	instance, _, err = GetPixelStreamingInstance(ctx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get instance")
+		return
+	}
+
+	writeJson(w, http.StatusOK, instance)
+}
+
+func listAdminSessions(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	var (
+		filter PixelStreamingSessionFilter
+		err    error
+	)
+
+	if filter.AppId, err = uuidParam(values, "appId"); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.InstanceId, err = uuidParam(values, "instanceId"); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.UserId, err = uuidParam(values, "userId"); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.Limit, err = limitParam(values); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.Status = stringParam(values, "status")
+
+	sessions, err := ListPixelStreamingSessions(r.Context(), filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusOK, sessions)
+}
+
+func closeAdminSession(w http.ResponseWriter, r *http.Request, rawId string) {
+	id, err := uuid.FromString(rawId)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid session id")
+		return
+	}
+
+	ctx := r.Context()
+	session, err := GetPixelStreamingSession(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get session")
+		return
+	}
+
+	if session.Status != nil && *session.Status == SESSION_STATUS_CLOSED {
+		writeError(w, http.StatusConflict, "session is already closed")
+		return
+	}
+
+	err = CloseSession(ctx, session, SESSION_END_REASON_ADMIN)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	session, err = GetPixelStreamingSession(ctx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get session")
+		return
+	}
+
+	writeJson(w, http.StatusOK, session)
+}
+
+// adminPathParts splits the path below the prefix, e.g. /admin/instances/{id}/stop returns [{id} stop].
+func adminPathParts(path string, prefix string) []string {
+	rest := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+
+	return strings.Split(rest, "/")
+}
+
+func uuidParam(values url.Values, name string) (*uuid.UUID, error) {
+	value := values.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+
+	id, err := uuid.FromString(value)
+	if err != nil {
+		return nil, errors.New("invalid " + name)
+	}
+
+	return &id, nil
+}
+
+func stringParam(values url.Values, name string) *string {
+	value := values.Get(name)
+	if value == "" {
+		return nil
+	}
+
+	return &value
+}
+
+func limitParam(values url.Values) (int, error) {
+	value := values.Get("limit")
+	if value == "" {
+		return ADMIN_LIST_LIMIT, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > ADMIN_LIST_MAX_LIMIT {
+		return 0, errors.New("invalid limit")
+	}
+
+	return limit, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ApiListenAddress = os.Getenv("OPERATOR_LISTEN")
+	LauncherToken    = os.Getenv("LAUNCHER_TOKEN")
+	AdminToken       = os.Getenv("ADMIN_TOKEN")
+	ApiToken         = os.Getenv("API_TOKEN")         // used by the backend creating sessions for its users
+	OperatorUrl      = os.Getenv("OPERATOR_URL")      // public HTTP API URL handed to launchers in the user data
+	OperatorGrpcUrl  = os.Getenv("OPERATOR_GRPC_URL") // public gRPC address handed to launchers in the user data
+)
+
+type ApiError struct {
+	Message string `json:"message"`
+}
+
+// ServeApi starts the operator HTTP API used by launchers and clients, it runs until the context is done.
+func ServeApi(ctx context.Context) error {
+	address := ApiListenAddress
+	if address == "" {
+		address = ":8080"
+	}
+
+	router, err := NewOpenApiRouter(ctx)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/openapi.json", handleOpenApi)
+	mux.Handle("/launcher/heartbeat", requireToken(&LauncherToken, http.HandlerFunc(handleLauncherHeartbeat)))
+	mux.Handle("/launcher/disconnect", requireToken(&LauncherToken, http.HandlerFunc(handleLauncherDisconnect)))
+	mux.Handle("/sessions", requireToken(&ApiToken, http.HandlerFunc(handleSessionCreate)))
+	mux.HandleFunc("/sessions/reconnect", handleSessionReconnect)
+	mux.HandleFunc("/regions", handleRegions)
+	mux.Handle("/usage", requireToken(&AdminToken, http.HandlerFunc(handleUsage)))
+	mux.Handle("/admin/instances", requireToken(&AdminToken, http.HandlerFunc(handleAdminInstances)))
+	mux.Handle("/admin/instances/", requireToken(&AdminToken, http.HandlerFunc(handleAdminInstances)))
+	mux.Handle("/admin/sessions", requireToken(&AdminToken, http.HandlerFunc(handleAdminSessions)))
+	mux.Handle("/admin/sessions/", requireToken(&AdminToken, http.HandlerFunc(handleAdminSessions)))
+	mux.Handle("/admin/rollouts", requireToken(&AdminToken, http.HandlerFunc(handleAdminRollouts)))
+	mux.Handle("/admin/rollouts/", requireToken(&AdminToken, http.HandlerFunc(handleAdminRollouts)))
+	mux.Handle("/admin/capacity", requireToken(&AdminToken, http.HandlerFunc(handleAdminCapacity)))
+	mux.Handle("/metrics", requireToken(&AdminToken, http.HandlerFunc(handleMetrics)))
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           withContext(ctx, validateRequest(router, mux)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	Logger.Infof("listening on %s", address)
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// withContext passes the database of the operator context to the request context.
+func withContext(ctx context.Context, next http.Handler) http.Handler {
+	db := ctx.Value("database")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "database", db)))
+	})
+}
+
+// requireToken rejects requests without the expected bearer token, all requests are rejected if the token is not configured.
+func requireToken(token *string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		value := strings.TrimPrefix(header, "Bearer ")
+		if *token == "" || value == header || subtle.ConstantTimeCompare([]byte(value), []byte(*token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v != nil {
+		_ = json.NewEncoder(w).Encode(v)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, ApiError{Message: message})
+}
+
+func readJson(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return false
+	}
+
+	return true
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"golang.org/x/exp/slices"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata"
+)
+
+// CAPACITY_DEFAULT_APP matches the default pool in the apps of a capacity profile
+const CAPACITY_DEFAULT_APP = "default"
+
+var (
+	cronMonthNames = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	cronDayNames   = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+	locations sync.Map // time zones of the capacity profiles keyed by name
+)
+
+// CapacityTarget is the warm capacity a pool keeps in a region, scaled by the weight of the pool.
+type CapacityTarget struct {
+	Profile   string             `json:"profile,omitempty"`  // active capacity profile, the base freeSlots apply without
+	FreeSlots map[string]int32   `json:"freeSlots"`          // keyed by spot or on-demand
+	Demand    map[string]float64 `json:"demand,omitempty"`   // free slots needed for the sessions arriving while an instance boots keyed by spot or on-demand, target-tracking pools only
+	Forecast  map[string]float64 `json:"forecast,omitempty"` // free slots needed for the forecast sessions keyed by spot or on-demand, raises freeSlots
+}
+
+// CapacityStatus is the capacity target of a pool in a region.
+type CapacityStatus struct {
+	RegionId  uuid.UUID  `json:"regionId"`
+	Region    string     `json:"region"`
+	ReleaseId *uuid.UUID `json:"releaseId,omitempty"`
+	AppId     *uuid.UUID `json:"appId,omitempty"`
+	Platform  string     `json:"platform"`
+	Weight    int32      `json:"weight"`
+	CapacityTarget
+}
+
+// CapacityTarget returns the free slots the pool keeps in the region at the time, those of the active capacity profile if there is one.
+func (p InstancePool) CapacityTarget(regionName string, now time.Time) CapacityTarget {
+	target := CapacityTarget{FreeSlots: make(map[string]int32)}
+	for instanceType := range Config.InstanceTypes {
+		target.FreeSlots[instanceType] = p.FreeSlots(instanceType)
+	}
+
+	profile := ActiveCapacityProfile(regionName, p, now)
+	if profile == nil {
+		return target
+	}
+
+	target.Profile = profile.Name
+	for instanceType, freeSlots := range profile.FreeSlots {
+		target.FreeSlots[instanceType] = p.scale(freeSlots)
+	}
+
+	return target
+}
+
+// freeSlotShares returns the share of each instance type in the free slots, equal shares if there are none.
+func freeSlotShares(freeSlots map[string]int32) map[string]float64 {
+	var total int32
+	for _, slots := range freeSlots {
+		total += slots
+	}
+
+	shares := make(map[string]float64)
+	for instanceType, slots := range freeSlots {
+		if total > 0 {
+			shares[instanceType] = float64(slots) / float64(total)
+		} else {
+			shares[instanceType] = 1 / float64(len(freeSlots))
+		}
+	}
+
+	return shares
+}
+
+// ActiveCapacityProfile returns the capacity profile of the pool in the region active at the time, nil if none is.
+func ActiveCapacityProfile(regionName string, pool InstancePool, now time.Time) (active *CapacityProfile) {
+	app := CAPACITY_DEFAULT_APP
+	if pool.AppId != nil {
+		app = pool.AppId.String()
+	}
+
+	for i := range Config.CapacityProfiles {
+		profile := &Config.CapacityProfiles[i]
+		if len(profile.Regions) > 0 && !slices.Contains(profile.Regions, regionName) {
+			continue
+		}
+
+		if len(profile.Apps) > 0 && !slices.Contains(profile.Apps, app) {
+			continue
+		}
+
+		if !profile.ActiveAt(now) {
+			continue
+		}
+
+		if active == nil || profile.Priority > active.Priority || profile.Priority == active.Priority && profile.specificity() > active.specificity() {
+			active = profile
+		}
+	}
+
+	return active
+}
+
+// ActiveAt reports whether one of the schedules of the profile is active at the time, invalid schedules never are.
+func (p *CapacityProfile) ActiveAt(now time.Time) bool {
+	location, err := loadLocation(p.Timezone)
+	if err != nil {
+		return false
+	}
+
+	for _, schedule := range p.Schedules {
+		cron, err := parseCron(schedule.Cron)
+		if err != nil {
+			continue
+		}
+
+		if cron.activeAt(now.In(location), schedule.Duration.Duration) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *CapacityProfile) specificity() (n int) {
+	if len(p.Regions) > 0 {
+		n++
+	}
+	if len(p.Apps) > 0 {
+		n++
+	}
+
+	return n
+}
+
+// ValidateCapacityProfiles checks the time zones and schedules of the capacity profiles.
+func ValidateCapacityProfiles() error {
+	for _, profile := range Config.CapacityProfiles {
+		if _, err := loadLocation(profile.Timezone); err != nil {
+			return fmt.Errorf("capacity profile %s: invalid timezone %s: %v", profile.Name, profile.Timezone, err)
+		}
+
+		for _, schedule := range profile.Schedules {
+			if _, err := parseCron(schedule.Cron); err != nil {
+				return fmt.Errorf("capacity profile %s: %v", profile.Name, err)
+			}
+
+			if schedule.Duration.Duration < time.Minute {
+				return fmt.Errorf("capacity profile %s: schedule %s lasts less than a minute", profile.Name, schedule.Cron)
+			}
+		}
+	}
+
+	return nil
+}
+
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+
+	if location, ok := locations.Load(name); ok {
+		return location.(*time.Location), nil
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	locations.Store(name, location)
+	return location, nil
+}
+
+// cronSchedule is a parsed cron expression, the fields hold a bit per matching value.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+// parseCron parses a cron expression with the fields minute hour day-of-month month day-of-week, each a *, values, ranges or steps
+// separated by commas, e.g. "0 18 * * FRI" or "*/30 8-20 * * MON-FRI". Months and days of week may be names, Sunday is 0 or 7.
+func parseCron(spec string) (c cronSchedule, err error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return c, fmt.Errorf("cron expression %q must have 5 fields", spec)
+	}
+
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return c, fmt.Errorf("cron expression %q: minute: %v", spec, err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return c, fmt.Errorf("cron expression %q: hour: %v", spec, err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return c, fmt.Errorf("cron expression %q: day of month: %v", spec, err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return c, fmt.Errorf("cron expression %q: month: %v", spec, err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return c, fmt.Errorf("cron expression %q: day of week: %v", spec, err)
+	}
+
+	// 7 is another Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+
+	return c, nil
+}
+
+func parseCronField(field string, low int, high int, names []string) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rangePart = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+		}
+
+		var from, to int
+		switch {
+		case rangePart == "*":
+			from, to = low, high
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			if from, err = parseCronValue(bounds[0], low, names); err != nil {
+				return 0, err
+			}
+			if to, err = parseCronValue(bounds[1], low, names); err != nil {
+				return 0, err
+			}
+		default:
+			if from, err = parseCronValue(rangePart, low, names); err != nil {
+				return 0, err
+			}
+			to = from
+			if step > 1 {
+				to = high
+			}
+		}
+
+		if from < low || to > high || from > to {
+			return 0, fmt.Errorf("%q is out of the range %d-%d", part, low, high)
+		}
+
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func parseCronValue(value string, low int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(value, name) {
+			return i + low, nil
+		}
+	}
+
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+
+	return v, nil
+}
+
+// matches reports whether the minute of the time matches, days match by day of month or day of week if both are restricted.
+func (c cronSchedule) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+
+	return dom || dow
+}
+
+// activeAt reports whether a window of the duration starting at a matching minute covers the time.
+func (c cronSchedule) activeAt(t time.Time, duration time.Duration) bool {
+	start := t.Truncate(time.Minute)
+	for offset := time.Duration(0); offset < duration; offset += time.Minute {
+		if c.matches(start.Add(-offset)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetCapacityStatus returns the planned capacity targets of every pool in every region at the time.
+func GetCapacityStatus(ctx context.Context, now time.Time) (statuses []CapacityStatus, err error) {
+	var regions map[uuid.UUID]string
+	regions, err = GetRegions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pools []InstancePool
+	pools, err = GetInstancePools(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for regionId, regionName := range regions {
+		for _, pool := range pools {
+			var target CapacityTarget
+			target, err = PlanCapacity(ctx, regionId, regionName, pool, now)
+			if err != nil {
+				return nil, err
+			}
+
+			statuses = append(statuses, CapacityStatus{
+				RegionId:       regionId,
+				Region:         regionName,
+				ReleaseId:      pool.ReleaseId,
+				AppId:          pool.AppId,
+				Platform:       pool.Platform,
+				Weight:         pool.Weight,
+				CapacityTarget: target,
+			})
+		}
+	}
+
+	// regions come from a map
+	slices.SortStableFunc(statuses, func(a, b CapacityStatus) bool {
+		return a.Region < b.Region
+	})
+
+	return statuses, nil
+}
+
+func handleAdminCapacity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	statuses, err := GetCapacityStatus(r.Context(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if statuses == nil {
+		statuses = []CapacityStatus{}
+	}
+
+	writeJson(w, http.StatusOK, statuses)
+}
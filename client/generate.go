@@ -0,0 +1,4 @@
+// Package client is the Go client of the operator HTTP API generated from openapi.json, it is used by the launcher.
+package client
+
+//go:generate go run github.com/oapi-codegen/oapi-codegen/v2/cmd/oapi-codegen@v2.3.0 -generate types,client -package client -o client.gen.go ../openapi.json
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/gofrs/uuid"
+	"os"
+	"time"
+)
+
+// Duration wraps time.Duration to be read from JSON as "90s", "30m", "2h" etc.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string, got %s", b)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// AppConfig holds per-app session limits, zero values fall back to the operator defaults.
+type AppConfig struct {
+	MaxSessionDuration Duration `json:"maxSessionDuration,omitempty"` // max time since session creation
+	IdleTimeout        Duration `json:"idleTimeout,omitempty"`        // max time since the last input reported by the launcher, or since the session started running or reconnected
+	StartTimeout       Duration `json:"startTimeout,omitempty"`       // max time a session can stay pending or starting
+	ReconnectGrace     Duration `json:"reconnectGrace,omitempty"`     // time the user has to reconnect to a disconnected session
+	Slots              int      `json:"slots,omitempty"`              // max sessions on an instance running the app, 0 uses all slots of the instance
+	ReleaseId          string   `json:"releaseId,omitempty"`          // release pool new sessions of the app use, pinning it disables rollouts of the app
+
+	ReleaseWeights map[string]int32 `json:"releaseWeights,omitempty"` // new sessions of the app are split between the release pools by weight, keyed by release id, disables rollouts of the app
+}
+
+// ReleasePool is the image the instances of a release are launched from.
+type ReleasePool struct {
+	ImageId           string            `json:"imageId,omitempty"`           // pinned image, the image is looked up by tags if not set
+	ImageTags         map[string]string `json:"imageTags,omitempty"`         // tags the images of the release have besides the app, version and platform tags
+	Platform          string            `json:"platform,omitempty"`          // windows or linux, the platform of the client build of the release if not set
+	LaunchTemplateIds map[string]string `json:"launchTemplateIds,omitempty"` // keyed by spot or on-demand, the default launch templates are used if not set
+
+	InstanceTypes map[string][]InstanceTypeOption `json:"instanceTypes,omitempty"` // keyed by spot or on-demand, the instance types of the platform are used if not set
+	Subnets       map[string][]SubnetConfig       `json:"subnets,omitempty"`       // keyed by region name, the subnets of the operator are used if not set
+	Scaling       *ScalingConfig                  `json:"scaling,omitempty"`       // the scaling of the operator is used if not set
+}
+
+// SubnetConfig is a subnet instances are launched into, pools spread their instances over the subnets of a region.
+type SubnetConfig struct {
+	Id               string `json:"id"`                         // e.g. subnet-0123456789abcdef0
+	AvailabilityZone string `json:"availabilityZone,omitempty"` // zone recorded on the instances, the zone EC2 reports if not set
+}
+
+// InstanceTypeOption is an EC2 instance type a pool may launch, the options of a pool are tried in order, e.g. the cheapest first.
+type InstanceTypeOption struct {
+	Type   string `json:"type"`             // e.g. g5.xlarge
+	Weight int    `json:"weight,omitempty"` // sessions an instance of the type runs at once, the slots of spot or on-demand if not set
+}
+
+// PlatformConfig holds the launch settings of the instances of a platform.
+type PlatformConfig struct {
+	LaunchTemplateIds map[string]string               `json:"launchTemplateIds,omitempty"` // keyed by spot or on-demand
+	InstanceTypes     map[string][]InstanceTypeOption `json:"instanceTypes,omitempty"`     // EC2 instance types in order of preference keyed by spot or on-demand
+	UserData          string                          `json:"userData,omitempty"`          // text/template of the user data rendered with UserDataParams per launch, the default template if not set
+}
+
+// ImageDiscovery selects the images instances are launched from by tags, the newest available image having all tags of the pool in the region is used.
+type ImageDiscovery struct {
+	Owners   []string          `json:"owners,omitempty"`   // image owners, defaults to self
+	Tags     map[string]string `json:"tags,omitempty"`     // tags every image has, e.g. the pipeline building them
+	CacheTtl Duration          `json:"cacheTtl,omitempty"` // time a resolved image is reused before it is looked up again
+}
+
+// CapacityProfile overrides the free slots the matching pools keep while one of its schedules is active, e.g. weekday evenings.
+// Of overlapping profiles the one with the highest priority applies, then the one with more filters, then the first configured.
+type CapacityProfile struct {
+	Name      string             `json:"name"`
+	Regions   []string           `json:"regions,omitempty"`  // region names, all regions if empty
+	Apps      []string           `json:"apps,omitempty"`     // app ids or "default" for the default pool, all pools if empty
+	Timezone  string             `json:"timezone,omitempty"` // IANA time zone the schedules are in, UTC if not set
+	Priority  int                `json:"priority,omitempty"`
+	Schedules []CapacitySchedule `json:"schedules"`
+	FreeSlots map[string]int32   `json:"freeSlots"` // keyed by spot or on-demand, replaces freeSlots for the types it has, scaled by the pool weight
+}
+
+// CapacitySchedule is a time window starting at every time matching the cron expression, e.g. "0 18 * * FRI" lasting 5h.
+type CapacitySchedule struct {
+	Cron     string   `json:"cron"` // minute hour day-of-month month day-of-week
+	Duration Duration `json:"duration"`
+}
+
+// ForecastConfig pre-warms the pools for the sessions forecast from the session history, the forecast for a window is the average number of
+// sessions started in the same window of the previous weeks, i.e. a seasonal moving average by hour of week.
+type ForecastConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Weeks    int      `json:"weeks,omitempty"`    // previous weeks averaged
+	Interval Duration `json:"interval,omitempty"` // length of the forecast windows
+	Headroom float64  `json:"headroom,omitempty"` // factor applied to the forecast, tune it with the forecast report
+}
+
+// ScalingConfig decides the free slots a pool keeps: the fixed freeSlots, or with target-tracking the slots the sessions arriving while a
+// fresh instance boots need, i.e. the recent session arrival rate multiplied by the measured boot time, bounded by the min and max free slots.
+// Excess free instances are only removed once the free slots exceed the target by the hysteresis, the cooldown has passed since the last
+// scaling of the pool and the instances have run for their minimum lifetime, at the end of a billing period if they are billed by period.
+type ScalingConfig struct {
+	Mode         string           `json:"mode,omitempty"`         // fixed or target-tracking
+	Window       Duration         `json:"window,omitempty"`       // time the session arrival rate is measured over
+	MinFreeSlots map[string]int32 `json:"minFreeSlots,omitempty"` // keyed by spot or on-demand, scaled by the pool weight
+	MaxFreeSlots map[string]int32 `json:"maxFreeSlots,omitempty"` // keyed by spot or on-demand, scaled by the pool weight, unbounded if not set
+
+	ScaleDownHysteresis int32    `json:"scaleDownHysteresis,omitempty"` // free slots above the target kept before instances are removed, scaled by the pool weight
+	ScaleDownCooldown   Duration `json:"scaleDownCooldown,omitempty"`   // time after the last launch, start or removal of an instance of the pool before instances are removed
+	MinLifetime         Duration `json:"minLifetime,omitempty"`         // time an instance runs since its launch or start before it may be removed
+	BillingPeriod       Duration `json:"billingPeriod,omitempty"`       // instances are only removed at the end of a paid period, e.g. 1h for hourly Windows licenses
+}
+
+// RecyclePolicy decides whether an instance is cleaned and reused after a session or terminated.
+type RecyclePolicy struct {
+	Recycle        bool     `json:"recycle"`
+	MaxSessions    int      `json:"maxSessions,omitempty"`    // terminate after this number of sessions
+	MaxAge         Duration `json:"maxAge,omitempty"`         // terminate instances older than this
+	CleanupTimeout Duration `json:"cleanupTimeout,omitempty"` // terminate if the launcher has not reported cleanup in time
+}
+
+type OperatorConfig struct {
+	Default         AppConfig                 `json:"default"`
+	Apps            map[string]AppConfig      `json:"apps,omitempty"`          // keyed by app id
+	InstanceTypes   map[string]RecyclePolicy  `json:"instanceTypes,omitempty"` // keyed by spot or on-demand
+	HourlyPrices    map[string]float64        `json:"hourlyPrices,omitempty"`  // USD per instance hour used to estimate session cost, keyed by spot or on-demand
+	DrainTimeout    Duration                  `json:"drainTimeout,omitempty"`  // time a draining instance waits for its session to end
+	Slots           map[string]int            `json:"slots,omitempty"`         // sessions an instance runs at once, keyed by spot or on-demand
+	FreeSlots       map[string]int32          `json:"freeSlots,omitempty"`     // free slots kept in each region by a pool receiving all new sessions of its apps, keyed by spot or on-demand
+	GeoIPDatabase   string                    `json:"geoipDatabase,omitempty"` // path of the MaxMind country or city database used to locate clients
+	Releases        map[string]ReleasePool    `json:"releases,omitempty"`      // instance pools keyed by release id
+	Images          ImageDiscovery            `json:"images"`
+	Platforms       map[string]PlatformConfig `json:"platforms,omitempty"`       // keyed by windows or linux
+	Subnets         map[string][]SubnetConfig `json:"subnets,omitempty"`         // subnets of the pools keyed by region name, instances use the subnet of the launch template in regions without
+	SpotLaunchMode  string                    `json:"spotLaunchMode,omitempty"`  // instances or fleet, fleets need spot launch templates without market options
+	Hibernate       bool                      `json:"hibernate"`                 // stop on-demand instances into hibernation, their launch template must enable it
+	StartingTimeout Duration                  `json:"startingTimeout,omitempty"` // time a started instance has until its launcher reports ready, it is terminated after
+	DefaultPlatform string                    `json:"defaultPlatform,omitempty"` // platform of the default pool
+	DefaultPool     bool                      `json:"defaultPool"`               // keep a pool launched from the default image for sessions without a release pool
+
+	RolloutPercentage    int32    `json:"rolloutPercentage,omitempty"`    // share of new sessions using a new release once its pool is warm, the previous release is retired at 100
+	RolloutWarmupTimeout Duration `json:"rolloutWarmupTimeout,omitempty"` // time a new release pool has to get a free instance in every region before the cutover
+
+	CapacityProfiles []CapacityProfile `json:"capacityProfiles,omitempty"` // scheduled free slots overriding freeSlots
+	Forecast         ForecastConfig    `json:"forecast"`                   // free slots raised to cover the forecast sessions
+	Scaling          ScalingConfig     `json:"scaling"`                    // scaling of the pools without their own
+	BootTime         Duration          `json:"bootTime,omitempty"`         // boot time of a fresh instance until launches have been measured
+}
+
+var Config = OperatorConfig{
+	Default: AppConfig{
+		MaxSessionDuration: Duration{4 * time.Hour},
+		IdleTimeout:        Duration{15 * time.Minute},
+		StartTimeout:       Duration{10 * time.Minute},
+		ReconnectGrace:     Duration{2 * time.Minute},
+	},
+	InstanceTypes: map[string]RecyclePolicy{
+		"spot": {
+			Recycle: false,
+		},
+		"on-demand": {
+			Recycle:        true,
+			MaxSessions:    10,
+			MaxAge:         Duration{24 * time.Hour},
+			CleanupTimeout: Duration{10 * time.Minute},
+		},
+	},
+	HourlyPrices: map[string]float64{
+		"spot":      0.45,
+		"on-demand": 1.19,
+	},
+	DrainTimeout: Duration{2 * time.Hour},
+	Slots: map[string]int{
+		"spot":      1,
+		"on-demand": 1,
+	},
+	FreeSlots: map[string]int32{
+		"spot":      FREE_SPOTS_AVAILABLE,
+		"on-demand": FREE_ON_DEMAND_AVAILABLE,
+	},
+	Images: ImageDiscovery{
+		Owners:   []string{"self"},
+		CacheTtl: Duration{10 * time.Minute},
+	},
+	Platforms: map[string]PlatformConfig{
+		PLATFORM_WINDOWS: {
+			LaunchTemplateIds: map[string]string{
+				"spot":      WIN_SPOT_LAUNCH_TEMPLATE_ID,
+				"on-demand": WIN_ON_DEMAND_LAUNCH_TEMPLATE_ID,
+			},
+			InstanceTypes: map[string][]InstanceTypeOption{
+				"spot":      {{Type: string(types.InstanceTypeG5Xlarge)}},
+				"on-demand": {{Type: string(types.InstanceTypeG5Xlarge)}},
+			},
+		},
+		PLATFORM_LINUX: {
+			LaunchTemplateIds: map[string]string{
+				"spot":      LINUX_SPOT_LAUNCH_TEMPLATE_ID,
+				"on-demand": LINUX_ON_DEMAND_LAUNCH_TEMPLATE_ID,
+			},
+			InstanceTypes: map[string][]InstanceTypeOption{
+				"spot":      {{Type: string(types.InstanceTypeG5Xlarge)}},
+				"on-demand": {{Type: string(types.InstanceTypeG5Xlarge)}},
+			},
+		},
+	},
+	DefaultPlatform:      PLATFORM_WINDOWS,
+	SpotLaunchMode:       LAUNCH_MODE_INSTANCES,
+	Hibernate:            true,
+	StartingTimeout:      Duration{15 * time.Minute},
+	DefaultPool:          true,
+	RolloutPercentage:    100,
+	RolloutWarmupTimeout: Duration{30 * time.Minute},
+	Forecast: ForecastConfig{
+		Weeks:    4,
+		Interval: Duration{time.Hour},
+		Headroom: 1.2,
+	},
+	Scaling: ScalingConfig{
+		Mode:              SCALING_MODE_FIXED,
+		Window:            Duration{15 * time.Minute},
+		ScaleDownCooldown: Duration{10 * time.Minute},
+	},
+	BootTime: Duration{10 * time.Minute},
+}
+
+// LoadConfig reads the operator configuration from the JSON file at path over the defaults, instance types and platforms with defaults
+// only override the fields they set.
+func LoadConfig(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config %s: %v", path, err)
+	}
+
+	// json replaces whole map values, the entries with defaults are decoded again over their default below
+	instanceTypes := make(map[string]RecyclePolicy)
+	for key, policy := range Config.InstanceTypes {
+		instanceTypes[key] = policy
+	}
+
+	platforms := make(map[string]PlatformConfig)
+	for key, platform := range Config.Platforms {
+		platforms[key] = platform
+	}
+
+	if err = json.Unmarshal(b, &Config); err != nil {
+		return fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+
+	var entries struct {
+		InstanceTypes map[string]json.RawMessage `json:"instanceTypes"`
+		Platforms     map[string]json.RawMessage `json:"platforms"`
+	}
+
+	if err = json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+
+	for key, entry := range entries.InstanceTypes {
+		policy, ok := instanceTypes[key]
+		if !ok {
+			continue
+		}
+
+		if err = json.Unmarshal(entry, &policy); err != nil {
+			return fmt.Errorf("failed to parse config %s: instance type %s: %v", path, key, err)
+		}
+		Config.InstanceTypes[key] = policy
+	}
+
+	for key, entry := range entries.Platforms {
+		platform, ok := platforms[key]
+		if !ok {
+			continue
+		}
+
+		if err = json.Unmarshal(entry, &platform); err != nil {
+			return fmt.Errorf("failed to parse config %s: platform %s: %v", path, key, err)
+		}
+		Config.Platforms[key] = platform
+	}
+
+	return nil
+}
+
+// App returns the configuration for the app merged over the defaults.
+func (c *OperatorConfig) App(appId *uuid.UUID) AppConfig {
+	r := c.Default
+	if appId == nil {
+		return r
+	}
+
+	a, ok := c.Apps[appId.String()]
+	if !ok {
+		return r
+	}
+
+	if a.MaxSessionDuration.Duration > 0 {
+		r.MaxSessionDuration = a.MaxSessionDuration
+	}
+	if a.IdleTimeout.Duration > 0 {
+		r.IdleTimeout = a.IdleTimeout
+	}
+	if a.StartTimeout.Duration > 0 {
+		r.StartTimeout = a.StartTimeout
+	}
+	if a.ReconnectGrace.Duration > 0 {
+		r.ReconnectGrace = a.ReconnectGrace
+	}
+	if a.Slots > 0 {
+		r.Slots = a.Slots
+	}
+	if a.ReleaseId != "" {
+		r.ReleaseId = a.ReleaseId
+	}
+	if len(a.ReleaseWeights) > 0 {
+		r.ReleaseWeights = a.ReleaseWeights
+	}
+
+	return r
+}
+
+// RolloutDisabled reports whether the releases of the app are picked by the configuration rather than by rollouts.
+func (a AppConfig) RolloutDisabled() bool {
+	return a.ReleaseId != "" || len(a.ReleaseWeights) > 0
+}
+
+// Recycle returns the recycle policy of the instance type, instances of unknown types are never recycled.
+func (c *OperatorConfig) Recycle(instanceType string) RecyclePolicy {
+	return c.InstanceTypes[instanceType]
+}
@@ -135,7 +135,7 @@ func IndexPixelStreamingInstances(ctx context.Context, status string, regionId u
 		return instances, fmt.Errorf("unable to get database connection")
 	}
 
-	q := `SELECT id, region_id, host, port, status, instance_id FROM pixel_streaming_instance WHERE status = $1 AND region_id = $2`
+	q := `SELECT id, release_id, region_id, host, port, status, instance_id FROM pixel_streaming_instance WHERE status = $1 AND region_id = $2`
 
 	var rows pgx.Rows
 	rows, err = db.Query(ctx, q, status, regionId)
@@ -167,6 +167,190 @@ func IndexPixelStreamingInstances(ctx context.Context, status string, regionId u
 	return instances, nil
 }
 
+// ListPixelStreamingInstances returns the instances matching all set fields of the filter.
+func ListPixelStreamingInstances(ctx context.Context, filter PixelStreamingInstanceFilter) (instances []PixelStreamingInstance, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return instances, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT id, release_id, region_id, host, port, status, instance_id, instance_type, session_count, slots, COALESCE(platform, 'windows'), ec2_instance_type, subnet_id, availability_zone, boot_kind, boot_seconds, created_at, updated_at
+FROM pixel_streaming_instance
+WHERE ($1::uuid IS NULL OR region_id = $1)
+	AND ($2::text IS NULL OR instance_type = $2)
+	AND ($3::text IS NULL OR status = $3)
+	AND ($4::uuid IS NULL OR release_id = $4)
+ORDER BY created_at DESC
+LIMIT $5`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, filter.RegionId, filter.InstanceType, filter.Status, filter.ReleaseId, filter.Limit)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get %s", PSInstancePlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var instance PixelStreamingInstance
+		err = rows.Scan(
+			&instance.Id,
+			&instance.ReleaseId,
+			&instance.RegionId,
+			&instance.Host,
+			&instance.Port,
+			&instance.Status,
+			&instance.InstanceId,
+			&instance.InstanceType,
+			&instance.SessionCount,
+			&instance.Slots,
+			&instance.Platform,
+			&instance.Ec2Type,
+			&instance.SubnetId,
+			&instance.Zone,
+			&instance.BootKind,
+			&instance.BootSeconds,
+			&instance.CreatedAt,
+			&instance.UpdatedAt,
+		)
+
+		if err != nil {
+			logrus.Errorf("failed to scan %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get %s", PSInstancePlural)
+		}
+
+		instances = append(instances, instance)
+	}
+
+	return instances, nil
+}
+
+// GetPixelStreamingInstance returns the instance with the name of its region.
+func GetPixelStreamingInstance(ctx context.Context, id uuid.UUID) (instance PixelStreamingInstance, regionName string, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return instance, "", fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT psi.id, psi.release_id, psi.region_id, psi.host, psi.port, psi.status, psi.instance_id, psi.instance_type, psi.slots, COALESCE(psi.platform, 'windows'), psi.ec2_instance_type, psi.subnet_id, psi.availability_zone, psi.boot_kind, psi.boot_seconds, r.name
+FROM pixel_streaming_instance psi
+	INNER JOIN region r ON r.id = psi.region_id
+WHERE psi.id = $1`
+
+	err = db.QueryRow(ctx, q, id).Scan(
+		&instance.Id,
+		&instance.ReleaseId,
+		&instance.RegionId,
+		&instance.Host,
+		&instance.Port,
+		&instance.Status,
+		&instance.InstanceId,
+		&instance.InstanceType,
+		&instance.Slots,
+		&instance.Platform,
+		&instance.Ec2Type,
+		&instance.SubnetId,
+		&instance.Zone,
+		&instance.BootKind,
+		&instance.BootSeconds,
+		&regionName,
+	)
+
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			logrus.Errorf("failed to get %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+		}
+		return instance, "", err
+	}
+
+	return instance, regionName, nil
+}
+
+// ListPixelStreamingSessions returns the sessions matching all set fields of the filter.
+func ListPixelStreamingSessions(ctx context.Context, filter PixelStreamingSessionFilter) (sessions []PixelStreamingSession, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return sessions, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT id, user_id, app_id, release_id, world_id, region_id, instance_id, slot, status, end_reason, last_input_at, disconnected_at, created_at, updated_at
+FROM pixel_streaming_sessions
+WHERE ($1::text IS NULL OR status = $1)
+	AND ($2::uuid IS NULL OR app_id = $2)
+	AND ($3::uuid IS NULL OR instance_id = $3)
+	AND ($4::uuid IS NULL OR user_id = $4)
+ORDER BY created_at DESC
+LIMIT $5`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, filter.Status, filter.AppId, filter.InstanceId, filter.UserId, filter.Limit)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get %s", PSSessionPlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var session PixelStreamingSession
+		err = rows.Scan(
+			&session.Id,
+			&session.UserId,
+			&session.AppId,
+			&session.ReleaseId,
+			&session.WorldId,
+			&session.RegionId,
+			&session.InstanceId,
+			&session.Slot,
+			&session.Status,
+			&session.EndReason,
+			&session.LastInputAt,
+			&session.DisconnectedAt,
+			&session.CreatedAt,
+			&session.UpdatedAt,
+		)
+
+		if err != nil {
+			logrus.Errorf("failed to scan %s @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get %s", PSSessionPlural)
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// GetPixelStreamingSession returns the session by id.
+func GetPixelStreamingSession(ctx context.Context, id uuid.UUID) (session PixelStreamingSession, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return session, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT id, user_id, app_id, release_id, world_id, region_id, instance_id, slot, status, end_reason, created_at, updated_at FROM pixel_streaming_sessions WHERE id = $1`
+
+	err = db.QueryRow(ctx, q, id).Scan(
+		&session.Id,
+		&session.UserId,
+		&session.AppId,
+		&session.ReleaseId,
+		&session.WorldId,
+		&session.RegionId,
+		&session.InstanceId,
+		&session.Slot,
+		&session.Status,
+		&session.EndReason,
+		&session.CreatedAt,
+		&session.UpdatedAt,
+	)
+
+	if err != nil && err != pgx.ErrNoRows {
+		logrus.Errorf("failed to get %s @ %s: %v", PSSessionSingular, reflect.FunctionName(), err)
+	}
+
+	return session, err
+}
+
 func UpdatePixelStreamingInstance(ctx context.Context, id *uuid.UUID, data PixelStreamingInstanceMetadata) (err error) {
 	logrus.Infof("change instance data to: %v instanceID: %s", data, id)
 
@@ -205,6 +389,11 @@ func UpdatePixelStreamingInstance(ctx context.Context, id *uuid.UUID, data Pixel
 		}
 
 		q += fmt.Sprintf(" status = '%s'", *data.Status)
+
+		// booting instances becoming free stop their boot clock, status still holds the previous status here
+		if *data.Status == INSTANCE_STATUS_FREE {
+			q += ", boot_seconds = CASE WHEN status IN ('pending', 'starting') AND boot_started_at IS NOT NULL THEN EXTRACT(EPOCH FROM now() - boot_started_at) ELSE boot_seconds END"
+		}
 	}
 
 	if isUpdate {
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"time"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+type drainingInstance struct {
+	Id            uuid.UUID
+	InstanceId    string
+	InstanceType  string
+	ReleaseId     *uuid.UUID
+	SessionCount  int
+	CreatedAt     *time.Time
+	DrainedAt     *time.Time
+	DrainDeadline *time.Time
+	Session       PixelStreamingSession // active session, Id is nil if there is none
+}
+
+// Deadline returns the time the instance is taken away regardless of its session.
+func (i drainingInstance) Deadline() time.Time {
+	if i.DrainDeadline != nil {
+		return *i.DrainDeadline
+	}
+
+	if i.DrainedAt != nil {
+		return i.DrainedAt.Add(Config.DrainTimeout.Duration)
+	}
+
+	return time.Time{}
+}
+
+// DrainInstances takes the instances out of rotation, they keep their current session.
+func DrainInstances(ctx context.Context, instanceIds []string) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_instance SET status = $1, drained_at = now(), updated_at = now() WHERE instance_id = ANY($2) AND status <> $1`
+
+	_, err = db.Exec(ctx, q, INSTANCE_STATUS_DRAINING, instanceIds)
+	if err != nil {
+		logrus.Errorf("failed to drain %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to drain %s", PSInstancePlural)
+	}
+
+	return nil
+}
+
+// SetDrainDeadline overrides the drain timeout of the draining instance.
+func SetDrainDeadline(ctx context.Context, id uuid.UUID, deadline time.Time) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	_, err = db.Exec(ctx, `UPDATE pixel_streaming_instance SET drain_deadline = $1 WHERE id = $2 AND status = $3`, deadline, id, INSTANCE_STATUS_DRAINING)
+	if err != nil {
+		logrus.Errorf("failed to update %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update %s", PSInstanceSingular)
+	}
+
+	return nil
+}
+
+// CompleteDrainingInstances stops (on-demand, if it can still be recycled and its release pool is kept) or terminates draining instances once their session has ended,
+// sessions still running at the drain deadline are closed. Sessions claimed by polling launchers after the drain are returned to pending.
+func CompleteDrainingInstances(ctx context.Context) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_sessions pss SET instance_id = NULL, slot = NULL, status = $1, assigned_at = NULL, updated_at = now()
+FROM pixel_streaming_instance psi
+WHERE psi.id = pss.instance_id AND psi.status = $2 AND pss.status = $3 AND pss.updated_at > psi.drained_at`
+
+	_, err = db.Exec(ctx, q, SESSION_STATUS_PENDING, INSTANCE_STATUS_DRAINING, SESSION_STATUS_STARTING)
+	if err != nil {
+		logrus.Errorf("failed to return %s to pending @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update %s", PSSessionPlural)
+	}
+
+	var pools []InstancePool
+	pools, err = GetInstancePools(ctx)
+	if err != nil {
+		return err
+	}
+
+	var regions map[uuid.UUID]string
+	regions, err = GetRegions(ctx)
+	if err != nil {
+		return err
+	}
+
+	for regionId, regionName := range regions {
+		var instances []drainingInstance
+		instances, err = getDrainingInstances(ctx, regionId)
+		if err != nil {
+			return err
+		}
+
+		var (
+			now                  = time.Now()
+			stopInstanceIds      []string
+			terminateInstanceIds []string
+		)
+
+		for _, instance := range instances {
+			if instance.Session.Id != nil {
+				if now.Before(instance.Deadline()) {
+					continue
+				}
+
+				logrus.Infof("%s %s drain deadline has passed, closing %s %s", PSInstanceSingular, instance.Id, PSSessionSingular, instance.Session.Id)
+
+				instance.Session.InstanceId = &instance.Id
+				err = CloseSession(ctx, instance.Session, SESSION_END_REASON_DRAINED)
+				if err != nil {
+					return err
+				}
+
+				// the closed session is released first, the instance is stopped or terminated on the next check
+				continue
+			}
+
+			if instance.InstanceType == "on-demand" && hasPool(pools, instance.ReleaseId) && Config.Recycle(instance.InstanceType).ShouldRecycle(instance.SessionCount, instance.CreatedAt, now) {
+				stopInstanceIds = append(stopInstanceIds, instance.InstanceId)
+			} else {
+				terminateInstanceIds = append(terminateInstanceIds, instance.InstanceId)
+			}
+		}
+
+		if len(stopInstanceIds) == 0 && len(terminateInstanceIds) == 0 {
+			continue
+		}
+
+		ec2Client, err := NewEC2Client(ctx, regionName)
+		if err != nil {
+			return err
+		}
+
+		err = ExecuteInstanceAction(ctx, ec2Client, "reconcile", INSTANCE_ACTION_STOP, stopInstanceIds)
+		if err != nil {
+			return fmt.Errorf("failed to stop drained instances: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		}
+
+		err = ExecuteInstanceAction(ctx, ec2Client, "reconcile", INSTANCE_ACTION_TERMINATE, terminateInstanceIds)
+		if err != nil {
+			return fmt.Errorf("failed to terminate drained instances: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		}
+	}
+
+	return nil
+}
+
+func getDrainingInstances(ctx context.Context, regionId uuid.UUID) (instances []drainingInstance, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT psi.id, psi.instance_id, psi.instance_type, psi.release_id, psi.session_count, psi.created_at, psi.drained_at, psi.drain_deadline, pss.id, pss.status
+FROM pixel_streaming_instance psi
+	LEFT JOIN pixel_streaming_sessions pss ON pss.instance_id = psi.id AND pss.status = ANY($3)
+WHERE psi.region_id = $1 AND psi.status = $2 AND psi.instance_id IS NOT NULL`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, regionId, INSTANCE_STATUS_DRAINING, ActiveSessionStatuses)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get %s", PSInstancePlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var instance drainingInstance
+		err = rows.Scan(
+			&instance.Id,
+			&instance.InstanceId,
+			&instance.InstanceType,
+			&instance.ReleaseId,
+			&instance.SessionCount,
+			&instance.CreatedAt,
+			&instance.DrainedAt,
+			&instance.DrainDeadline,
+			&instance.Session.Id,
+			&instance.Session.Status,
+		)
+
+		if err != nil {
+			logrus.Errorf("failed to scan %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get %s", PSInstancePlural)
+		}
+
+		instances = append(instances, instance)
+	}
+
+	return instances, nil
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/smithy-go"
+	"github.com/sirupsen/logrus"
 )
 
 type EC2API interface {
@@ -22,12 +23,32 @@ type EC2API interface {
 		params *ec2.RebootInstancesInput,
 		optFns ...func(*ec2.Options)) (*ec2.RebootInstancesOutput, error)
 
+	StartInstances(ctx context.Context,
+		params *ec2.StartInstancesInput,
+		optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error)
+
 	StopInstances(ctx context.Context,
 		params *ec2.StopInstancesInput,
 		optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error)
 	TerminateInstances(ctx context.Context,
 		params *ec2.TerminateInstancesInput,
 		optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error)
+
+	DescribeImages(ctx context.Context,
+		params *ec2.DescribeImagesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error)
+
+	CreateFleet(ctx context.Context,
+		params *ec2.CreateFleetInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateFleetOutput, error)
+
+	CreateLaunchTemplateVersion(ctx context.Context,
+		params *ec2.CreateLaunchTemplateVersionInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateLaunchTemplateVersionOutput, error)
+
+	DeleteLaunchTemplateVersions(ctx context.Context,
+		params *ec2.DeleteLaunchTemplateVersionsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteLaunchTemplateVersionsOutput, error)
 }
 
 // MakeInstance creates an Amazon Elastic Compute Cloud (Amazon EC2) instance.
@@ -45,6 +66,21 @@ func MakeInstance(c context.Context, api EC2API, input *ec2.RunInstancesInput) (
 	return api.RunInstances(c, input)
 }
 
+// MakeFleet creates an Amazon Elastic Compute Cloud (Amazon EC2) Fleet, instant fleets launch their instances right away.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a CreateFleetOutput object containing the launched instances and the launch errors and nil.
+//	Otherwise, nil and an error from the call to CreateFleet.
+func MakeFleet(c context.Context, api EC2API, input *ec2.CreateFleetInput) (*ec2.CreateFleetOutput, error) {
+	return api.CreateFleet(c, input)
+}
+
 // GetInstances retrieves information about your Amazon Elastic Compute Cloud (Amazon EC2) instances.
 // Inputs:
 //
@@ -84,6 +120,30 @@ func RebootInstance(c context.Context, api EC2API, input *ec2.RebootInstancesInp
 	return resp, err
 }
 
+// StartInstance starts a stopped Amazon Elastic Compute Cloud (Amazon EC2) instance.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a StartInstancesOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to StartInstances.
+func StartInstance(c context.Context, api EC2API, input *ec2.StartInstancesInput) (*ec2.StartInstancesOutput, error) {
+	resp, err := api.StartInstances(c, input)
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation" {
+		logrus.Debugf("user has permission to start instances")
+		input.DryRun = aws.Bool(false)
+		return api.StartInstances(c, input)
+	}
+
+	return resp, err
+}
+
 // StopInstance stops an Amazon Elastic Compute Cloud (Amazon EC2) instance.
 // Inputs:
 //
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"strconv"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+const (
+	// LAUNCH_MODE_INSTANCES launches spot instances with RunInstances, one instance type and subnet at a time
+	LAUNCH_MODE_INSTANCES = "instances"
+	// LAUNCH_MODE_FLEET launches spot instances with instant EC2 Fleets across all instance types and subnets of the pool
+	LAUNCH_MODE_FLEET = "fleet"
+)
+
+// launchPendingFleetInstance launches the spot instance of the row with an instant EC2 Fleet. The fleet allocates it to the instance type
+// and subnet with the most spare capacity, preferring the earlier instance type options and the subnets with fewer instances of the pool.
+// Every option gets a launch template version with the user data rendered for its type, the versions are deleted once the fleet is created.
+func launchPendingFleetInstance(ctx context.Context, api EC2API, regionId uuid.UUID, regionName string, pool InstancePool, instanceType string, input *ec2.RunInstancesInput, instance PixelStreamingInstance, spread *subnetSpread) (err error) {
+	params := pendingUserDataParams(regionId, regionName, pool, instanceType, instance)
+
+	options := pool.InstanceTypeOptions(instanceType)
+	if len(options) == 0 {
+		logrus.Errorf("no %s instance types configured for %s pools", instanceType, pool.Platform)
+		return ErrNoCapacity
+	}
+
+	launchTemplateId := pool.LaunchTemplateId(instanceType)
+
+	var versions []string
+	defer func() {
+		deleteLaunchTemplateVersions(ctx, api, launchTemplateId, versions)
+	}()
+
+	var (
+		configs  []types.FleetLaunchTemplateConfigRequest
+		priority float64
+	)
+
+	for _, option := range options {
+		subnets := spread.Candidates(option.Type)
+		if len(subnets) == 0 {
+			continue
+		}
+
+		params.Ec2InstanceType = option.Type
+		params.Slots = int32(option.Weight)
+
+		var userData string
+		userData, err = RenderUserData(pool.Platform, params)
+		if err != nil {
+			// launching without the settings would leave a launcher which never connects
+			return fmt.Errorf("failed to render user data of %s %s @ %s: %v", PSInstanceSingular, instance.Id, reflect.FunctionName(), err)
+		}
+
+		var version *ec2.CreateLaunchTemplateVersionOutput
+		version, err = api.CreateLaunchTemplateVersion(ctx, &ec2.CreateLaunchTemplateVersionInput{
+			LaunchTemplateId:   aws.String(launchTemplateId),
+			SourceVersion:      aws.String("$Default"),
+			VersionDescription: aws.String(fmt.Sprintf("%s %s %s", PSInstanceSingular, instance.Id, option.Type)),
+			LaunchTemplateData: &types.RequestLaunchTemplateData{
+				ImageId:  aws.String(pool.ImageId),
+				KeyName:  input.KeyName,
+				UserData: aws.String(userData),
+			},
+		})
+		if err != nil || version.LaunchTemplateVersion == nil || version.LaunchTemplateVersion.VersionNumber == nil {
+			return fmt.Errorf("failed to create launch template version of %s: %s @ %s: %v", launchTemplateId, PSInstanceSingular, reflect.FunctionName(), err)
+		}
+
+		versionNumber := strconv.FormatInt(*version.LaunchTemplateVersion.VersionNumber, 10)
+		versions = append(versions, versionNumber)
+
+		config := types.FleetLaunchTemplateConfigRequest{
+			LaunchTemplateSpecification: &types.FleetLaunchTemplateSpecificationRequest{
+				LaunchTemplateId: aws.String(launchTemplateId),
+				Version:          aws.String(versionNumber),
+			},
+		}
+
+		for _, subnet := range subnets {
+			config.Overrides = append(config.Overrides, types.FleetLaunchTemplateOverridesRequest{
+				InstanceType: types.InstanceType(option.Type),
+				SubnetId:     subnetString(subnet.Id),
+				Priority:     aws.Float64(priority),
+			})
+			priority++
+		}
+
+		configs = append(configs, config)
+	}
+
+	if len(configs) == 0 {
+		return ErrNoCapacity
+	}
+
+	tagSpecifications := pool.RunInstancesInput(input, instanceType).TagSpecifications
+	for i := range tagSpecifications {
+		tagSpecifications[i].Tags = append(tagSpecifications[i].Tags, types.Tag{
+			Key:   aws.String(INSTANCE_ID_TAG),
+			Value: aws.String(instance.Id.String()),
+		})
+	}
+
+	var output *ec2.CreateFleetOutput
+	output, err = MakeFleet(ctx, api, &ec2.CreateFleetInput{
+		Type:                  types.FleetTypeInstant,
+		LaunchTemplateConfigs: configs,
+		TargetCapacitySpecification: &types.TargetCapacitySpecificationRequest{
+			TotalTargetCapacity:       aws.Int32(1),
+			SpotTargetCapacity:        aws.Int32(1),
+			DefaultTargetCapacityType: types.DefaultTargetCapacityTypeSpot,
+		},
+		SpotOptions: &types.SpotOptionsRequest{
+			AllocationStrategy: types.SpotAllocationStrategyCapacityOptimizedPrioritized,
+		},
+		TagSpecifications: tagSpecifications,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create %s fleet: %s @ %s: %v", instanceType, PSInstancePlural, reflect.FunctionName(), err)
+	}
+
+	for _, launched := range output.Instances {
+		if len(launched.InstanceIds) == 0 {
+			continue
+		}
+
+		logrus.Infof("Making required free %s instances with a fleet: %v", instanceType, launched.InstanceIds)
+
+		var overrides types.FleetLaunchTemplateOverrides
+		if launched.LaunchTemplateAndOverrides != nil && launched.LaunchTemplateAndOverrides.Overrides != nil {
+			overrides = *launched.LaunchTemplateAndOverrides.Overrides
+		}
+
+		optionIndex := slices.IndexFunc(options, func(option InstanceTypeOption) bool {
+			return option.Type == string(launched.InstanceType)
+		})
+		if optionIndex < 0 {
+			logrus.Warnf("fleet launched %s which is not an instance type option of the pool", launched.InstanceType)
+			optionIndex = 0
+		}
+
+		subnet := SubnetConfig{Id: aws.ToString(overrides.SubnetId)}
+		for _, s := range spread.subnets {
+			if s.Id == subnet.Id {
+				subnet = s
+			}
+		}
+		spread.Launched(subnet)
+
+		availabilityZone := subnetString(subnet.AvailabilityZone)
+		if overrides.AvailabilityZone != nil {
+			availabilityZone = overrides.AvailabilityZone
+		}
+
+		return recordLaunchedInstance(ctx, instance.Id, launched.InstanceIds[0], options[optionIndex], subnetString(subnet.Id), availabilityZone)
+	}
+
+	// the fleet reports the launch errors of every instance type and subnet it tried
+	for _, fleetErr := range output.Errors {
+		code := aws.ToString(fleetErr.ErrorCode)
+		if !slices.Contains(capacityErrorCodes, code) {
+			return fmt.Errorf("failed to launch %s fleet instance: %s @ %s: %s: %s", instanceType, PSInstanceSingular, reflect.FunctionName(), code, aws.ToString(fleetErr.ErrorMessage))
+		}
+
+		if fleetErr.LaunchTemplateAndOverrides != nil && fleetErr.LaunchTemplateAndOverrides.Overrides != nil {
+			overrides := fleetErr.LaunchTemplateAndOverrides.Overrides
+			spread.Exhausted(SubnetConfig{Id: aws.ToString(overrides.SubnetId)}, string(overrides.InstanceType))
+		}
+	}
+
+	return ErrNoCapacity
+}
+
+// deleteLaunchTemplateVersions deletes the launch template versions created for a fleet, the instances it launched keep running.
+func deleteLaunchTemplateVersions(ctx context.Context, api EC2API, launchTemplateId string, versions []string) {
+	if len(versions) == 0 {
+		return
+	}
+
+	output, err := api.DeleteLaunchTemplateVersions(ctx, &ec2.DeleteLaunchTemplateVersionsInput{
+		LaunchTemplateId: aws.String(launchTemplateId),
+		Versions:         versions,
+	})
+	if err != nil {
+		logrus.Errorf("failed to delete versions %v of launch template %s @ %s: %v", versions, launchTemplateId, reflect.FunctionName(), err)
+		return
+	}
+
+	for _, failed := range output.UnsuccessfullyDeletedLaunchTemplateVersions {
+		if failed.ResponseError != nil {
+			logrus.Errorf("failed to delete version %d of launch template %s: %s", aws.ToInt64(failed.VersionNumber), launchTemplateId, aws.ToString(failed.ResponseError.Message))
+		}
+	}
+}
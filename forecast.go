@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"math"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+const (
+	// FORECAST_DEFAULT_KEY is the forecast key of the sessions without a release pool, other keys are app ids
+	FORECAST_DEFAULT_KEY = "default"
+
+	week = 7 * 24 * time.Hour
+)
+
+// ForecastReport compares the recorded forecasts of the session starts of an app in a region with the actual starts.
+type ForecastReport struct {
+	Region   string
+	Key      string  // app id or default
+	Windows  int     // forecast windows which have passed
+	Forecast float64 // forecast session starts of all windows
+	Actual   int     // actual session starts of all windows
+	Error    float64 // mean absolute error per window
+	Covered  int     // windows whose actual starts did not exceed the forecast with headroom
+}
+
+// forecastKey returns the key of the sessions the pool serves, the default pool serves the sessions without a release.
+func forecastKey(pool InstancePool) string {
+	if pool.ReleaseId == nil || pool.AppId == nil {
+		return FORECAST_DEFAULT_KEY
+	}
+
+	return pool.AppId.String()
+}
+
+// ValidateForecast checks the forecast settings if forecasts are enabled.
+func ValidateForecast() error {
+	if !Config.Forecast.Enabled {
+		return nil
+	}
+
+	if Config.Forecast.Weeks <= 0 {
+		return fmt.Errorf("forecast weeks must be positive")
+	}
+
+	if Config.Forecast.Interval.Duration < time.Minute {
+		return fmt.Errorf("forecast interval must be at least a minute")
+	}
+
+	if Config.Forecast.Headroom <= 0 {
+		return fmt.Errorf("forecast headroom must be positive")
+	}
+
+	return nil
+}
+
+// ForecastSessionStarts forecasts the session starts of the key in the region within the window as the average of the starts in the same
+// window of the previous weeks (Config.Forecast.Weeks at most), false is returned if the region has less than a week of history.
+func ForecastSessionStarts(ctx context.Context, regionId uuid.UUID, key string, from time.Time, to time.Time) (starts float64, ok bool, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return 0, false, fmt.Errorf("unable to get database connection")
+	}
+
+	var first *time.Time
+	err = db.QueryRow(ctx, `SELECT MIN(created_at) FROM pixel_streaming_sessions WHERE region_id = $1`, regionId).Scan(&first)
+	if err != nil {
+		logrus.Errorf("failed to query %s history @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+		return 0, false, fmt.Errorf("failed to get %s history", PSSessionPlural)
+	}
+
+	if first == nil {
+		return 0, false, nil
+	}
+
+	weeks := int(from.Sub(*first) / week)
+	if weeks > Config.Forecast.Weeks {
+		weeks = Config.Forecast.Weeks
+	}
+
+	if weeks <= 0 {
+		return 0, false, nil
+	}
+
+	q := `SELECT COUNT(*) FROM pixel_streaming_sessions s, generate_series(1, $4::int) w
+WHERE s.region_id = $1 AND s.created_at >= $2::timestamptz - w * interval '1 week' AND s.created_at < $3::timestamptz - w * interval '1 week'
+	AND ($5 = $6 AND s.release_id IS NULL OR s.app_id::text = $5 AND s.release_id IS NOT NULL)`
+
+	var count int64
+	err = db.QueryRow(ctx, q, regionId, from, to, weeks, key, FORECAST_DEFAULT_KEY).Scan(&count)
+	if err != nil {
+		logrus.Errorf("failed to query %s history @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+		return 0, false, fmt.Errorf("failed to get %s history", PSSessionPlural)
+	}
+
+	return float64(count) / float64(weeks), true, nil
+}
+
+// GetBootLatency returns the average time fresh instances of the type took to become free in the region over the last week,
+// Config.BootTime until launches have been measured.
+func GetBootLatency(ctx context.Context, regionId uuid.UUID, instanceType string) (latency time.Duration, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return 0, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT AVG(boot_seconds) FROM pixel_streaming_instance
+WHERE region_id = $1 AND instance_type = $2 AND boot_kind = $3 AND boot_seconds IS NOT NULL AND boot_started_at > now() - interval '7 days'`
+
+	var seconds *float64
+	err = db.QueryRow(ctx, q, regionId, instanceType, BOOT_KIND_LAUNCH).Scan(&seconds)
+	if err != nil {
+		logrus.Errorf("failed to query %s boot times @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return 0, fmt.Errorf("failed to get %s boot times", PSInstancePlural)
+	}
+
+	if seconds == nil {
+		return Config.BootTime.Duration, nil
+	}
+
+	return time.Duration(*seconds * float64(time.Second)), nil
+}
+
+// PlanCapacity returns the capacity target of the pool in the region at the time: the fixed free slots, those of the active capacity profile
+// or those tracking the session demand. With forecasts enabled the free slots of each instance type are raised to cover the session starts
+// forecast for the window starting once a fresh instance would have booted, multiplied by the headroom and the weight of the pool and split
+// between the instance types like their free slots.
+func PlanCapacity(ctx context.Context, regionId uuid.UUID, regionName string, pool InstancePool, now time.Time) (target CapacityTarget, err error) {
+	target = pool.CapacityTarget(regionName, now)
+
+	err = TrackDemand(ctx, regionId, pool, &target, now)
+	if err != nil {
+		return target, err
+	}
+
+	if !Config.Forecast.Enabled || pool.Weight <= 0 {
+		return target, nil
+	}
+
+	target.Forecast = make(map[string]float64)
+	for instanceType, share := range freeSlotShares(target.FreeSlots) {
+		var latency time.Duration
+		latency, err = GetBootLatency(ctx, regionId, instanceType)
+		if err != nil {
+			return target, err
+		}
+
+		from := now.Add(latency)
+
+		var (
+			starts float64
+			ok     bool
+		)
+
+		starts, ok, err = ForecastSessionStarts(ctx, regionId, forecastKey(pool), from, from.Add(Config.Forecast.Interval.Duration))
+		if err != nil {
+			return target, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		forecast := starts * Config.Forecast.Headroom * float64(pool.Weight) / 100 * share
+		target.Forecast[instanceType] = math.Round(forecast*100) / 100
+
+		if slots := int32(math.Ceil(forecast)); slots > target.FreeSlots[instanceType] {
+			target.FreeSlots[instanceType] = slots
+		}
+	}
+
+	return target, nil
+}
+
+// RecordForecasts records the session starts forecast for the next window of every app with a pool in every region, once per window,
+// to compare them with the actual starts in the forecast report.
+func RecordForecasts(ctx context.Context) (err error) {
+	if !Config.Forecast.Enabled {
+		return nil
+	}
+
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	var regions map[uuid.UUID]string
+	regions, err = GetRegions(ctx)
+	if err != nil {
+		return err
+	}
+
+	var pools []InstancePool
+	pools, err = GetInstancePools(ctx)
+	if err != nil {
+		return err
+	}
+
+	interval := Config.Forecast.Interval.Duration
+	from := time.Now().Truncate(interval).Add(interval)
+	to := from.Add(interval)
+
+	for regionId := range regions {
+		recorded := make(map[string]bool)
+		for _, pool := range pools {
+			key := forecastKey(pool)
+			if recorded[key] {
+				continue
+			}
+			recorded[key] = true
+
+			var starts float64
+			starts, ok, err = ForecastSessionStarts(ctx, regionId, key, from, to)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				continue
+			}
+
+			q := `INSERT INTO pixel_streaming_forecast (region_id, app_key, window_start, window_end, forecast, created_at) VALUES ($1, $2, $3, $4, $5, now())
+ON CONFLICT (region_id, app_key, window_start) DO NOTHING`
+
+			_, err = db.Exec(ctx, q, regionId, key, from, to, starts)
+			if err != nil {
+				logrus.Errorf("failed to insert forecast @ %s: %v", reflect.FunctionName(), err)
+				return fmt.Errorf("failed to record forecast")
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetForecastReports compares the forecasts of the windows which have passed since the time with the actual session starts.
+func GetForecastReports(ctx context.Context, since time.Time) (reports []ForecastReport, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT r.name, f.app_key, COUNT(*), SUM(f.forecast), SUM(a.actual), AVG(ABS(f.forecast - a.actual)), COUNT(*) FILTER (WHERE a.actual <= f.forecast * $2)
+FROM pixel_streaming_forecast f
+	INNER JOIN region r ON r.id = f.region_id
+	CROSS JOIN LATERAL (
+		SELECT COUNT(*) AS actual FROM pixel_streaming_sessions s
+		WHERE s.region_id = f.region_id AND s.created_at >= f.window_start AND s.created_at < f.window_end
+			AND (f.app_key = $3 AND s.release_id IS NULL OR s.app_id::text = f.app_key AND s.release_id IS NOT NULL)
+	) a
+WHERE f.window_start >= $1 AND f.window_end <= now()
+GROUP BY r.name, f.app_key
+ORDER BY r.name, f.app_key`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, since, Config.Forecast.Headroom, FORECAST_DEFAULT_KEY)
+	if err != nil {
+		logrus.Errorf("failed to query forecasts @ %s: %v", reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get forecasts")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var report ForecastReport
+		err = rows.Scan(&report.Region, &report.Key, &report.Windows, &report.Forecast, &report.Actual, &report.Error, &report.Covered)
+		if err != nil {
+			logrus.Errorf("failed to scan forecasts @ %s: %v", reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get forecasts")
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// Bias returns the actual starts relative to the forecast, above 1 the forecast is too low.
+func (r ForecastReport) Bias() float64 {
+	if r.Forecast == 0 {
+		return 0
+	}
+
+	return float64(r.Actual) / r.Forecast
+}
+
+// RunForecastCommand prints the forecast report, e.g. to tune the headroom of the forecasts.
+func RunForecastCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("forecast", flag.ContinueOnError)
+	days := flags.Int("days", 7, "days of forecast windows compared")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	reports, err := GetForecastReports(ctx, time.Now().AddDate(0, 0, -*days))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join([]string{"region", "app", "windows", "forecast", "actual", "mean abs error", "actual/forecast", "covered by headroom"}, "\t")))
+	for _, r := range reports {
+		fmt.Fprintln(w, strings.Join([]string{
+			r.Region,
+			r.Key,
+			fmt.Sprintf("%d", r.Windows),
+			fmt.Sprintf("%.1f", r.Forecast),
+			fmt.Sprintf("%d", r.Actual),
+			fmt.Sprintf("%.2f", r.Error),
+			fmt.Sprintf("%.2f", r.Bias()),
+			fmt.Sprintf("%.1f%%", float64(r.Covered)/float64(r.Windows)*100),
+		}, "\t"))
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"veverse-pixelstreaming-operator/launcherpb"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+var (
+	GrpcListenAddress = os.Getenv("OPERATOR_GRPC_LISTEN")
+
+	// dispatchInterval is the fallback interval of DispatchPendingSessions, launchers connecting or reporting free trigger it immediately
+	dispatchInterval = 5 * time.Second
+
+	// Launchers are the launchers connected to this operator over gRPC, launchers without a stream keep polling the API
+	Launchers = NewLauncherRegistry()
+)
+
+// LauncherRegistry tracks the connected launcher streams by the pixel_streaming_instance id.
+type LauncherRegistry struct {
+	mu          sync.RWMutex
+	connections map[uuid.UUID]*launcherConnection
+	instanceIds map[string]uuid.UUID // EC2 instance id to pixel_streaming_instance id
+	dispatch    chan struct{}
+}
+
+type launcherConnection struct {
+	id         uuid.UUID
+	instanceId string
+	commands   chan *launcherpb.OperatorCommand
+}
+
+func NewLauncherRegistry() *LauncherRegistry {
+	return &LauncherRegistry{
+		connections: make(map[uuid.UUID]*launcherConnection),
+		instanceIds: make(map[string]uuid.UUID),
+		dispatch:    make(chan struct{}, 1),
+	}
+}
+
+func (r *LauncherRegistry) register(c *launcherConnection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if previous, ok := r.connections[c.id]; ok {
+		close(previous.commands)
+	}
+
+	r.connections[c.id] = c
+	if c.instanceId != "" {
+		r.instanceIds[c.instanceId] = c.id
+	}
+}
+
+func (r *LauncherRegistry) unregister(c *launcherConnection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.connections[c.id] != c {
+		return
+	}
+
+	delete(r.connections, c.id)
+	if c.instanceId != "" {
+		delete(r.instanceIds, c.instanceId)
+	}
+	close(c.commands)
+}
+
+// Connected returns the pixel_streaming_instance ids of the connected launchers.
+func (r *LauncherRegistry) Connected() (ids []uuid.UUID) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for id := range r.connections {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// Send queues the command to the launcher of the instance, it returns false if the launcher is not connected or not reading its commands.
+func (r *LauncherRegistry) Send(id uuid.UUID, command *launcherpb.OperatorCommand) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.connections[id]
+	if !ok {
+		return false
+	}
+
+	if command.CommandId == "" {
+		commandId, _ := uuid.NewV4()
+		command.CommandId = commandId.String()
+	}
+
+	select {
+	case c.commands <- command:
+		return true
+	default:
+		logrus.Warnf("launcher %s command queue is full, dropping command %s", id, command.CommandId)
+		return false
+	}
+}
+
+// SendByInstanceId queues the command to the launcher running on the EC2 instance.
+func (r *LauncherRegistry) SendByInstanceId(instanceId string, command *launcherpb.OperatorCommand) bool {
+	r.mu.RLock()
+	id, ok := r.instanceIds[instanceId]
+	r.mu.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	return r.Send(id, command)
+}
+
+// TriggerDispatch wakes up the dispatch loop without waiting for the interval.
+func (r *LauncherRegistry) TriggerDispatch() {
+	select {
+	case r.dispatch <- struct{}{}:
+	default:
+	}
+}
+
+type launcherServer struct {
+	launcherpb.UnimplementedLauncherServiceServer
+	ctx context.Context
+}
+
+// ServeGrpc starts the gRPC launcher service and the session dispatch loop, it runs until the context is done.
+func ServeGrpc(ctx context.Context) error {
+	address := GrpcListenAddress
+	if address == "" {
+		address = ":9090"
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+
+	server := grpc.NewServer()
+	launcherpb.RegisterLauncherServiceServer(server, &launcherServer{ctx: ctx})
+
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+
+	go DispatchLoop(ctx)
+
+	Logger.Infof("grpc listening on %s", address)
+	return server.Serve(listener)
+}
+
+func (s *launcherServer) Connect(stream launcherpb.LauncherService_ConnectServer) error {
+	if err := authorizeLauncherStream(stream.Context()); err != nil {
+		return err
+	}
+
+	// requests are served with the operator context to have the database
+	ctx := context.WithValue(stream.Context(), "database", s.ctx.Value("database"))
+
+	message, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	hello := message.GetHello()
+	if hello == nil {
+		return status.Error(codes.InvalidArgument, "first message must be hello")
+	}
+
+	id, err := uuid.FromString(hello.InstanceId)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "invalid instance id")
+	}
+
+	instanceId, err := getEC2InstanceId(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return status.Error(codes.NotFound, "instance not found")
+	} else if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	connection := &launcherConnection{
+		id:         id,
+		instanceId: instanceId,
+		commands:   make(chan *launcherpb.OperatorCommand, 16),
+	}
+
+	Launchers.register(connection)
+	defer Launchers.unregister(connection)
+
+	logrus.Infof("launcher %s (%s) connected, version %s", id, instanceId, hello.Version)
+	Launchers.TriggerDispatch()
+
+	errs := make(chan error, 2)
+
+	go func() {
+		for command := range connection.commands {
+			if err := stream.Send(command); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- status.Error(codes.Aborted, "replaced by a new connection")
+	}()
+
+	go func() {
+		for {
+			message, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if err := handleLauncherMessage(ctx, id, message); err != nil {
+				logrus.Errorf("failed to handle launcher %s message: %v", id, err)
+			}
+		}
+	}()
+
+	err = <-errs
+	logrus.Infof("launcher %s disconnected: %v", id, err)
+
+	return nil
+}
+
+func handleLauncherMessage(ctx context.Context, id uuid.UUID, message *launcherpb.LauncherMessage) error {
+	switch m := message.Message.(type) {
+	case *launcherpb.LauncherMessage_Heartbeat:
+		if !slices.Contains(LauncherStatuses, m.Heartbeat.Status) {
+			return fmt.Errorf("unknown status %s", m.Heartbeat.Status)
+		}
+
+		heartbeat := LauncherHeartbeat{
+			InstanceId: &id,
+			Status:     m.Heartbeat.Status,
+		}
+
+		if sessionId, err := uuid.FromString(m.Heartbeat.SessionId); err == nil {
+			heartbeat.SessionId = &sessionId
+		}
+
+		if m.Heartbeat.LastInputAt != nil {
+			lastInputAt := m.Heartbeat.LastInputAt.AsTime()
+			heartbeat.LastInputAt = &lastInputAt
+		}
+
+		if err := HandleLauncherHeartbeat(ctx, heartbeat); err != nil {
+			return err
+		}
+
+		if heartbeat.Status == LAUNCHER_STATUS_FREE || heartbeat.Status == LAUNCHER_STATUS_CLEANED {
+			Launchers.TriggerDispatch()
+		}
+	case *launcherpb.LauncherMessage_Result:
+		if !m.Result.Ok {
+			logrus.Warnf("launcher %s failed command %s: %s", id, m.Result.CommandId, m.Result.Error)
+		}
+	}
+
+	return nil
+}
+
+func authorizeLauncherStream(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		token := strings.TrimPrefix(value, "Bearer ")
+		if LauncherToken != "" && token != value && subtle.ConstantTimeCompare([]byte(token), []byte(LauncherToken)) == 1 {
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+func getEC2InstanceId(ctx context.Context, id uuid.UUID) (instanceId string, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return "", fmt.Errorf("unable to get database connection")
+	}
+
+	var value *string
+	err = db.QueryRow(ctx, `SELECT instance_id FROM pixel_streaming_instance WHERE id = $1`, id).Scan(&value)
+	if err != nil {
+		return "", err
+	}
+
+	if value != nil {
+		instanceId = *value
+	}
+
+	return instanceId, nil
+}
+
+// DispatchLoop pushes pending sessions to connected launchers as soon as they are free.
+func DispatchLoop(ctx context.Context) {
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-Launchers.dispatch:
+		}
+
+		if err := DispatchPendingSessions(ctx); err != nil {
+			logrus.Errorf("failed to dispatch pending sessions: %v", err)
+		}
+	}
+}
+
+// DispatchPendingSessions assigns pending sessions to free slots of instances of their region and release with a connected launcher and sends them the start command,
+// sessions left pending are still picked up by polling launchers.
+func DispatchPendingSessions(ctx context.Context) (err error) {
+	connected := Launchers.Connected()
+	if len(connected) == 0 {
+		return nil
+	}
+
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	var instances []instanceSlots
+	instances, err = GetInstanceSlots(ctx, connected)
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		for instance.Capacity() > 0 {
+			slot := instance.FreeSlot()
+			if slot < 0 {
+				break
+			}
+
+			var session PixelStreamingSession
+
+			q := `UPDATE pixel_streaming_sessions SET instance_id = $1, slot = $2, status = $3, assigned_at = now(), updated_at = now()
+WHERE id = (SELECT id FROM pixel_streaming_sessions WHERE status = $4 AND instance_id IS NULL AND (region_id IS NULL OR region_id = $5) AND release_id IS NOT DISTINCT FROM $6
+	AND (app_id IS NULL OR app_id <> ALL($7))
+	ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED)
+RETURNING id, app_id, world_id, slot`
+
+			err = db.QueryRow(ctx, q, instance.Id, slot, SESSION_STATUS_STARTING, SESSION_STATUS_PENDING, instance.RegionId, instance.ReleaseId, instance.ExcludedAppIds()).Scan(&session.Id, &session.AppId, &session.WorldId, &session.Slot)
+			if errors.Is(err, pgx.ErrNoRows) {
+				break
+			} else if err != nil {
+				logrus.Errorf("failed to assign %s @ %s: %v", PSSessionSingular, reflect.FunctionName(), err)
+				return fmt.Errorf("failed to assign %s", PSSessionSingular)
+			}
+
+			command := NewStartSessionCommand(session, PixelStreamingInstance{Port: instance.Port})
+			if !Launchers.Send(instance.Id, command) {
+				// the launcher has gone meanwhile, return the session to the pending ones
+				_, err = db.Exec(ctx, `UPDATE pixel_streaming_sessions SET instance_id = NULL, slot = NULL, status = $1, assigned_at = NULL, updated_at = now() WHERE id = $2 AND status = $3`, SESSION_STATUS_PENDING, session.Id, SESSION_STATUS_STARTING)
+				if err != nil {
+					logrus.Errorf("failed to unassign %s @ %s: %v", PSSessionSingular, reflect.FunctionName(), err)
+					return fmt.Errorf("failed to unassign %s", PSSessionSingular)
+				}
+				break
+			}
+
+			logrus.Infof("dispatched %s %s to %s %s slot %d", PSSessionSingular, session.Id, PSInstanceSingular, instance.Id, slot)
+
+			instance.Active++
+			instance.Used[slot] = true
+			if session.AppId != nil {
+				instance.AppIds = append(instance.AppIds, *session.AppId)
+			}
+		}
+	}
+
+	return nil
+}
+
+// NewStartSessionCommand makes the command with the app arguments, e.g. Metaverse.exe -AppID=... -WorldID=... -psport=..., the port is the one of the session slot.
+func NewStartSessionCommand(session PixelStreamingSession, instance PixelStreamingInstance) *launcherpb.OperatorCommand {
+	start := &launcherpb.StartSession{
+		SessionId: session.Id.String(),
+	}
+
+	if session.AppId != nil {
+		start.AppId = session.AppId.String()
+		start.Args = append(start.Args, "-AppID="+start.AppId)
+	}
+
+	if session.WorldId != nil {
+		start.WorldId = session.WorldId.String()
+		start.Args = append(start.Args, "-WorldID="+start.WorldId)
+	}
+
+	if session.Slot != nil {
+		start.Slot = *session.Slot
+	}
+
+	if instance.Port != nil {
+		start.Args = append(start.Args, fmt.Sprintf("-psport=%d", SlotPort(*instance.Port, int(start.Slot))))
+	}
+
+	return &launcherpb.OperatorCommand{
+		Command: &launcherpb.OperatorCommand_StartSession{StartSession: start},
+	}
+}
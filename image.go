@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// IMAGE_APP_TAG holds the app id of the images built for a release, images of the default pool have "default" instead
+	IMAGE_APP_TAG = "PixelStreamingAppId"
+	// IMAGE_VERSION_TAG holds the version of the release the image has been built for
+	IMAGE_VERSION_TAG = "PixelStreamingReleaseVersion"
+	// IMAGE_PLATFORM_TAG holds the platform of the image, windows or linux
+	IMAGE_PLATFORM_TAG = "PixelStreamingPlatform"
+
+	IMAGE_DEFAULT_APP = "default"
+)
+
+var (
+	ErrNoImage = errors.New("no image matches the pool")
+
+	images = imageCache{entries: make(map[string]cachedImages)}
+)
+
+// poolImages are the images matching the tags of a pool in a region.
+type poolImages struct {
+	ImageId  string   // newest available image, empty if no image is available yet
+	ImageIds []string // all matching images including older and pending ones, the instances of the pool run one of them
+}
+
+type cachedImages struct {
+	poolImages
+	expiresAt time.Time
+}
+
+// imageCache keeps the images resolved in each region for Config.Images.CacheTtl.
+type imageCache struct {
+	sync.Mutex
+	entries map[string]cachedImages
+}
+
+// ImageTags returns the tags the images of the pool have.
+func (p InstancePool) ImageTags() map[string]string {
+	tags := map[string]string{
+		IMAGE_APP_TAG:      IMAGE_DEFAULT_APP,
+		IMAGE_PLATFORM_TAG: p.Platform,
+	}
+
+	for key, value := range Config.Images.Tags {
+		tags[key] = value
+	}
+
+	if p.AppId != nil {
+		tags[IMAGE_APP_TAG] = p.AppId.String()
+	}
+
+	if p.Version != "" {
+		tags[IMAGE_VERSION_TAG] = p.Version
+	}
+
+	for key, value := range p.ExtraImageTags {
+		tags[key] = value
+	}
+
+	return tags
+}
+
+// ResolvePoolImages returns the pool with the images of the region, pools with a configured image keep it.
+// ErrNoImage is returned if no image matches the tags of the pool in the region.
+func ResolvePoolImages(ctx context.Context, api EC2API, regionName string, pool InstancePool) (InstancePool, error) {
+	if pool.ImageId != "" {
+		pool.ImageIds = []string{pool.ImageId}
+		return pool, nil
+	}
+
+	tags := pool.ImageTags()
+	key := imageCacheKey(regionName, tags)
+
+	images.Lock()
+	cached, ok := images.entries[key]
+	images.Unlock()
+
+	if ok && time.Now().Before(cached.expiresAt) {
+		pool.ImageId, pool.ImageIds = cached.ImageId, cached.ImageIds
+		return pool, nil
+	}
+
+	resolved, err := DescribePoolImages(ctx, api, tags)
+	if err != nil {
+		return pool, err
+	}
+
+	if len(resolved.ImageIds) == 0 {
+		return pool, ErrNoImage
+	}
+
+	// images which are not available yet are looked up again on the next check
+	if resolved.ImageId != "" {
+		images.Lock()
+		images.entries[key] = cachedImages{poolImages: resolved, expiresAt: time.Now().Add(Config.Images.CacheTtl.Duration)}
+		images.Unlock()
+	}
+
+	pool.ImageId, pool.ImageIds = resolved.ImageId, resolved.ImageIds
+	return pool, nil
+}
+
+// DescribePoolImages looks up the images of the configured owners having all the tags, the newest available one is launched.
+func DescribePoolImages(ctx context.Context, api EC2API, tags map[string]string) (resolved poolImages, err error) {
+	// without owners EC2 would match the public and shared images of any account having the tags
+	owners := Config.Images.Owners
+	if len(owners) == 0 {
+		owners = []string{"self"}
+	}
+
+	input := &ec2.DescribeImagesInput{
+		Owners: owners,
+	}
+
+	for key, value := range tags {
+		input.Filters = append(input.Filters, NewEC2Filter("tag:"+key, value))
+	}
+
+	output, err := api.DescribeImages(ctx, input)
+	if err != nil {
+		return resolved, fmt.Errorf("failed to describe images: %v", err)
+	}
+
+	var available []types.Image
+	for _, image := range output.Images {
+		if image.ImageId == nil {
+			continue
+		}
+
+		switch image.State {
+		case types.ImageStateAvailable:
+			available = append(available, image)
+			resolved.ImageIds = append(resolved.ImageIds, *image.ImageId)
+		case types.ImageStatePending:
+			resolved.ImageIds = append(resolved.ImageIds, *image.ImageId)
+		}
+	}
+
+	// creation dates are ISO 8601 and sort as strings
+	sort.Slice(available, func(i, j int) bool {
+		return aws.ToString(available[i].CreationDate) > aws.ToString(available[j].CreationDate)
+	})
+
+	if len(available) > 0 {
+		resolved.ImageId = *available[0].ImageId
+	}
+
+	return resolved, nil
+}
+
+// resolveLaunchImage resolves the images of the pool before the planner checks it, without an image the planner only skips launching.
+func resolveLaunchImage(ctx context.Context, api EC2API, regionName string, pool *InstancePool) {
+	resolved, err := ResolvePoolImages(ctx, api, regionName, *pool)
+	if errors.Is(err, ErrNoImage) {
+		logrus.Warnf("no image with tags %v in %s, the pool of release %s is not launched there", pool.ImageTags(), regionName, pool.ReleaseId)
+		return
+	} else if err != nil {
+		logrus.Errorf("failed to resolve the image of release %s in %s: %v", pool.ReleaseId, regionName, err)
+		return
+	}
+
+	*pool = resolved
+}
+
+func imageCacheKey(regionName string, tags map[string]string) string {
+	parts := []string{regionName}
+	for key, value := range tags {
+		parts = append(parts, key+"="+value)
+	}
+
+	sort.Strings(parts[1:])
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"text/template"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+const (
+	// INSTANCE_ID_TAG holds the pixel_streaming_instance id of the EC2 instance launched for the row
+	INSTANCE_ID_TAG = "PixelStreamingInstanceId"
+
+	// USER_DATA_MAX_SIZE is the EC2 limit of the user data before it is base64 encoded
+	USER_DATA_MAX_SIZE = 16 * 1024
+)
+
+var (
+	ErrNoCapacity = errors.New("no capacity for any instance type")
+
+	// capacityErrorCodes are the RunInstances errors after which the next subnet or instance type is tried
+	capacityErrorCodes = []string{
+		"InsufficientInstanceCapacity",
+		"InstanceLimitExceeded",
+		"MaxSpotInstanceCountExceeded",
+		"SpotMaxPriceTooLow",
+		"UnfulfillableCapacity",
+		"Unsupported",
+		"VcpuLimitExceeded",
+	}
+)
+
+// defaultUserData are the user data templates of the platforms without a configured one, they hand the launcher its settings.
+var defaultUserData = map[string]string{
+	PLATFORM_WINDOWS: `<powershell>
+$config = @{
+	instanceId = "{{.InstanceId}}"
+	regionId = "{{.RegionId}}"
+	region = "{{.Region}}"
+	releaseId = "{{.ReleaseId}}"
+	releaseVersion = "{{.ReleaseVersion}}"
+	port = {{.Port}}
+	slots = {{.Slots}}
+	operatorUrl = "{{.OperatorUrl}}"
+	operatorGrpcUrl = "{{.OperatorGrpcUrl}}"
+	launcherToken = "{{.LauncherToken}}"
+}
+New-Item -ItemType Directory -Force -Path "C:\ProgramData\VeVerse" | Out-Null
+$config | ConvertTo-Json | Set-Content -Path "C:\ProgramData\VeVerse\launcher.json"
+Restart-Service -Name "ve-ps-launcher"
+</powershell>
+`,
+	PLATFORM_LINUX: `#cloud-config
+write_files:
+  - path: /etc/veverse/launcher.json
+    permissions: "0600"
+    content: |
+      {
+        "instanceId": "{{.InstanceId}}",
+        "regionId": "{{.RegionId}}",
+        "region": "{{.Region}}",
+        "releaseId": "{{.ReleaseId}}",
+        "releaseVersion": "{{.ReleaseVersion}}",
+        "port": {{.Port}},
+        "slots": {{.Slots}},
+        "operatorUrl": "{{.OperatorUrl}}",
+        "operatorGrpcUrl": "{{.OperatorGrpcUrl}}",
+        "launcherToken": "{{.LauncherToken}}"
+      }
+runcmd:
+  - systemctl restart ve-ps-launcher
+`,
+}
+
+// UserDataParams are the values the user data template of an instance is rendered with.
+type UserDataParams struct {
+	InstanceId      string // pixel_streaming_instance id the launcher identifies itself with
+	RegionId        string
+	Region          string // region name, e.g. eu-central-1
+	ReleaseId       string // empty for the default pool
+	ReleaseVersion  string
+	AppId           string
+	Platform        string
+	InstanceType    string // spot or on-demand
+	Ec2InstanceType string // e.g. g5.xlarge
+	Port            uint16
+	Slots           int32
+	OperatorUrl     string
+	OperatorGrpcUrl string
+	LauncherToken   string
+}
+
+// UserDataTemplate returns the user data template of the platform, the default one if none is configured.
+func (c *OperatorConfig) UserDataTemplate(platform string) string {
+	if userData := c.Platform(platform).UserData; userData != "" {
+		return userData
+	}
+
+	return defaultUserData[platform]
+}
+
+// RenderUserData renders the user data template of the platform and returns it base64 encoded, it fails if it exceeds the EC2 limit.
+func RenderUserData(platform string, params UserDataParams) (string, error) {
+	t, err := template.New(platform).Option("missingkey=error").Parse(Config.UserDataTemplate(platform))
+	if err != nil {
+		return "", fmt.Errorf("invalid %s user data template: %v", platform, err)
+	}
+
+	var b bytes.Buffer
+	if err = t.Execute(&b, params); err != nil {
+		return "", fmt.Errorf("failed to render %s user data: %v", platform, err)
+	}
+
+	if b.Len() > USER_DATA_MAX_SIZE {
+		return "", fmt.Errorf("%s user data is %d bytes, EC2 accepts up to %d", platform, b.Len(), USER_DATA_MAX_SIZE)
+	}
+
+	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+// ValidateUserDataTemplates renders the user data template of every platform with sample values.
+func ValidateUserDataTemplates() error {
+	for _, platform := range Platforms {
+		_, err := RenderUserData(platform, UserDataParams{
+			InstanceId:      uuid.Nil.String(),
+			RegionId:        uuid.Nil.String(),
+			Region:          "eu-central-1",
+			ReleaseId:       uuid.Nil.String(),
+			ReleaseVersion:  "1.0.0",
+			AppId:           uuid.Nil.String(),
+			Platform:        platform,
+			InstanceType:    "on-demand",
+			Ec2InstanceType: string(types.InstanceTypeG5Xlarge),
+			Port:            80,
+			Slots:           1,
+			OperatorUrl:     OperatorUrl,
+			OperatorGrpcUrl: OperatorGrpcUrl,
+			LauncherToken:   LauncherToken,
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LaunchPendingInstances launches an EC2 instance for every pending row of the pool without one, each with its own user data
+// and tagged with the row id, the EC2 instance id is recorded on the row right away.
+func LaunchPendingInstances(ctx context.Context, api EC2API, regionId uuid.UUID, regionName string, pool InstancePool, instanceType string, input *ec2.RunInstancesInput) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT id, port, slots FROM pixel_streaming_instance
+WHERE region_id = $1 AND instance_type = $2 AND status = $3 AND instance_id IS NULL AND release_id IS NOT DISTINCT FROM $4 AND COALESCE(platform, 'windows') = $5`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, regionId, instanceType, INSTANCE_STATUS_PENDING, pool.ReleaseId, pool.Platform)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to get %s", PSInstancePlural)
+	}
+
+	var pending []PixelStreamingInstance
+	for rows.Next() {
+		var instance PixelStreamingInstance
+		err = rows.Scan(&instance.Id, &instance.Port, &instance.Slots)
+		if err != nil {
+			rows.Close()
+			logrus.Errorf("failed to scan %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return fmt.Errorf("failed to get %s", PSInstancePlural)
+		}
+
+		pending = append(pending, instance)
+	}
+	rows.Close()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	spread, err := newSubnetSpread(ctx, regionId, regionName, pool)
+	if err != nil {
+		return err
+	}
+
+	launch := launchPendingInstance
+	if instanceType == "spot" && Config.SpotLaunchMode == LAUNCH_MODE_FLEET {
+		launch = launchPendingFleetInstance
+	}
+
+	for _, instance := range pending {
+		err = launch(ctx, api, regionId, regionName, pool, instanceType, input, instance, spread)
+		if errors.Is(err, ErrNoCapacity) {
+			// the other rows would not get capacity either, they are launched on a later check
+			logrus.Warnf("no capacity for %s %s instances of release %s in %s", pool.Platform, instanceType, pool.ReleaseId, regionName)
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// launchPendingInstance launches the row with the first instance type option of the pool EC2 has capacity for, each type is tried in
+// the subnets of the region with the fewest instances of the pool first. The instance type, its slots, the subnet and the availability
+// zone are recorded on the row.
+func launchPendingInstance(ctx context.Context, api EC2API, regionId uuid.UUID, regionName string, pool InstancePool, instanceType string, input *ec2.RunInstancesInput, instance PixelStreamingInstance, spread *subnetSpread) (err error) {
+	params := pendingUserDataParams(regionId, regionName, pool, instanceType, instance)
+
+	options := pool.InstanceTypeOptions(instanceType)
+	if len(options) == 0 {
+		logrus.Errorf("no %s instance types configured for %s pools", instanceType, pool.Platform)
+		return ErrNoCapacity
+	}
+
+	for _, option := range options {
+		params.Ec2InstanceType = option.Type
+		params.Slots = int32(option.Weight)
+
+		var userData string
+		userData, err = RenderUserData(pool.Platform, params)
+		if err != nil {
+			// launching without the settings would leave a launcher which never connects
+			return fmt.Errorf("failed to render user data of %s %s @ %s: %v", PSInstanceSingular, instance.Id, reflect.FunctionName(), err)
+		}
+
+		for _, subnet := range spread.Candidates(option.Type) {
+			runInstanceInput := pool.RunInstancesInput(input, instanceType)
+			runInstanceInput.InstanceType = types.InstanceType(option.Type)
+			runInstanceInput.SubnetId = subnetString(subnet.Id)
+			runInstanceInput.MinCount = aws.Int32(1)
+			runInstanceInput.MaxCount = aws.Int32(1)
+			runInstanceInput.UserData = aws.String(userData)
+			for i := range runInstanceInput.TagSpecifications {
+				runInstanceInput.TagSpecifications[i].Tags = append(runInstanceInput.TagSpecifications[i].Tags, types.Tag{
+					Key:   aws.String(INSTANCE_ID_TAG),
+					Value: aws.String(instance.Id.String()),
+				})
+			}
+
+			var output *ec2.RunInstancesOutput
+			output, err = MakeInstance(ctx, api, runInstanceInput)
+			if IsCapacityError(err) {
+				logrus.Warnf("no capacity for %s in %s %s, trying the next subnet or instance type: %v", option.Type, regionName, subnet.Id, err)
+				spread.Exhausted(subnet, option.Type)
+				continue
+			} else if err != nil {
+				return fmt.Errorf("failed to create %s instance: %s @ %s: %v", instanceType, PSInstancePlural, reflect.FunctionName(), err)
+			}
+
+			logrus.Infof("Making required free %s instances: %v", instanceType, output.Instances)
+			spread.Launched(subnet)
+
+			if len(output.Instances) == 0 || output.Instances[0].InstanceId == nil {
+				return nil
+			}
+
+			launched := output.Instances[0]
+			subnetId, availabilityZone := subnetString(subnet.Id), subnetString(subnet.AvailabilityZone)
+			if launched.SubnetId != nil {
+				subnetId = launched.SubnetId
+			}
+			if launched.Placement != nil && launched.Placement.AvailabilityZone != nil {
+				availabilityZone = launched.Placement.AvailabilityZone
+			}
+
+			return recordLaunchedInstance(ctx, instance.Id, *launched.InstanceId, option, subnetId, availabilityZone)
+		}
+	}
+
+	return ErrNoCapacity
+}
+
+// recordLaunchedInstance records the EC2 instance launched for the pending row, with its instance type option, subnet and availability zone.
+func recordLaunchedInstance(ctx context.Context, id *uuid.UUID, instanceId string, option InstanceTypeOption, subnetId *string, availabilityZone *string) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_instance
+SET instance_id = $1, ec2_instance_type = $2, slots = $3, subnet_id = $4, availability_zone = $5, boot_kind = $6, boot_started_at = now(), updated_at = now()
+WHERE id = $7`
+	_, err = db.Exec(ctx, q, instanceId, option.Type, option.Weight, subnetId, availabilityZone, BOOT_KIND_LAUNCH, id)
+	if err != nil {
+		logrus.Errorf("failed to update launched %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update %s", PSInstanceSingular)
+	}
+
+	return nil
+}
+
+// markLaunchedInstanceFree records the address of the running EC2 instance launched for the row and frees the row, which stops its boot clock.
+// Only pending rows are freed, the rows of instances in use, cleaning or draining keep their status.
+func markLaunchedInstanceFree(ctx context.Context, id uuid.UUID, instanceId string, host string) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_instance
+SET instance_id = $1, host = $2, status = $3,
+	boot_seconds = CASE WHEN boot_started_at IS NOT NULL THEN EXTRACT(EPOCH FROM now() - boot_started_at) ELSE boot_seconds END, updated_at = now()
+WHERE id = $4 AND status = $5`
+	_, err = db.Exec(ctx, q, instanceId, host, INSTANCE_STATUS_FREE, id, INSTANCE_STATUS_PENDING)
+	if err != nil {
+		logrus.Errorf("failed to update launched %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update %s", PSInstanceSingular)
+	}
+
+	return nil
+}
+
+// pendingUserDataParams returns the user data values of the pending row, the EC2 instance type and slots are set per instance type option.
+func pendingUserDataParams(regionId uuid.UUID, regionName string, pool InstancePool, instanceType string, instance PixelStreamingInstance) UserDataParams {
+	params := UserDataParams{
+		InstanceId:      instance.Id.String(),
+		RegionId:        regionId.String(),
+		Region:          regionName,
+		ReleaseVersion:  pool.Version,
+		Platform:        pool.Platform,
+		InstanceType:    instanceType,
+		Port:            aws.ToUint16(instance.Port),
+		OperatorUrl:     OperatorUrl,
+		OperatorGrpcUrl: OperatorGrpcUrl,
+		LauncherToken:   LauncherToken,
+	}
+
+	if pool.ReleaseId != nil {
+		params.ReleaseId = pool.ReleaseId.String()
+	}
+
+	if pool.AppId != nil {
+		params.AppId = pool.AppId.String()
+	}
+
+	return params
+}
+
+// IsCapacityError reports whether EC2 refused the launch for lack of capacity or limits of the instance type, another subnet or type may succeed.
+func IsCapacityError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	return slices.Contains(capacityErrorCodes, apiErr.ErrorCode())
+}
+
+// launchedRowId returns the row the running EC2 instance has been launched for, instances launched without the row tag take
+// the first of the pending rows.
+func launchedRowId(instance types.Instance, pendingInstanceUUIDs *[]uuid.UUID) (uuid.UUID, bool) {
+	for _, tag := range instance.Tags {
+		if aws.ToString(tag.Key) != INSTANCE_ID_TAG {
+			continue
+		}
+
+		if id, err := uuid.FromString(aws.ToString(tag.Value)); err == nil {
+			return id, true
+		}
+	}
+
+	if len(*pendingInstanceUUIDs) == 0 {
+		return uuid.Nil, false
+	}
+
+	id := (*pendingInstanceUUIDs)[0]
+	*pendingInstanceUUIDs = (*pendingInstanceUUIDs)[1:]
+	return id, true
+}
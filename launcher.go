@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"net/http"
+	"time"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+const (
+	LAUNCHER_STATUS_FREE           = "free"
+	LAUNCHER_STATUS_OCCUPIED       = "occupied"
+	LAUNCHER_STATUS_CLEANED        = "cleaned"
+	LAUNCHER_STATUS_CLEANUP_FAILED = "cleanup-failed"
+)
+
+// LauncherStatuses lists the statuses accepted in launcher heartbeats
+var LauncherStatuses = []string{LAUNCHER_STATUS_FREE, LAUNCHER_STATUS_OCCUPIED, LAUNCHER_STATUS_CLEANED, LAUNCHER_STATUS_CLEANUP_FAILED}
+
+// LauncherHeartbeat is sent periodically by the launcher running on the instance.
+type LauncherHeartbeat struct {
+	InstanceId  *uuid.UUID `json:"instanceId"`            // pixel_streaming_instance id
+	SessionId   *uuid.UUID `json:"sessionId,omitempty"`   // session served by the launcher
+	Status      string     `json:"status"`                // free, occupied, cleaned or cleanup-failed
+	LastInputAt *time.Time `json:"lastInputAt,omitempty"` // last input received from the user of the session
+}
+
+func handleLauncherHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var heartbeat LauncherHeartbeat
+	if !readJson(w, r, &heartbeat) {
+		return
+	}
+
+	if heartbeat.InstanceId == nil {
+		writeError(w, http.StatusBadRequest, "instanceId is required")
+		return
+	}
+
+	if !slices.Contains(LauncherStatuses, heartbeat.Status) {
+		writeError(w, http.StatusBadRequest, "unknown status")
+		return
+	}
+
+	if err := HandleLauncherHeartbeat(r.Context(), heartbeat); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusNoContent, nil)
+}
+
+// HandleLauncherHeartbeat records the session activity, finishes the cleanup of the instance reported by the launcher and marks the
+// launchers of started instances ready.
+func HandleLauncherHeartbeat(ctx context.Context, heartbeat LauncherHeartbeat) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	if heartbeat.SessionId != nil {
+		// sessions assigned to the instance outside the operator are seen once their launcher reports them, usage is counted from then
+		q := `UPDATE pixel_streaming_sessions SET assigned_at = now() WHERE id = $1 AND instance_id = $2 AND assigned_at IS NULL`
+
+		_, err = db.Exec(ctx, q, heartbeat.SessionId, heartbeat.InstanceId)
+		if err != nil {
+			logrus.Errorf("failed to update %s @ %s: %v", PSSessionSingular, reflect.FunctionName(), err)
+			return fmt.Errorf("failed to update %s", PSSessionSingular)
+		}
+	}
+
+	if heartbeat.SessionId != nil && heartbeat.LastInputAt != nil {
+		q := `UPDATE pixel_streaming_sessions SET last_input_at = $1 WHERE id = $2 AND instance_id = $3 AND (last_input_at IS NULL OR last_input_at < $1)`
+
+		_, err = db.Exec(ctx, q, heartbeat.LastInputAt, heartbeat.SessionId, heartbeat.InstanceId)
+		if err != nil {
+			logrus.Errorf("failed to update %s @ %s: %v", PSSessionSingular, reflect.FunctionName(), err)
+			return fmt.Errorf("failed to update %s", PSSessionSingular)
+		}
+	}
+
+	var status string
+	switch heartbeat.Status {
+	case LAUNCHER_STATUS_FREE:
+		// a free launcher of a started instance is ready for sessions
+		return MarkLauncherReady(ctx, *heartbeat.InstanceId)
+	case LAUNCHER_STATUS_CLEANED:
+		status = INSTANCE_STATUS_FREE
+	case LAUNCHER_STATUS_CLEANUP_FAILED:
+		status = INSTANCE_STATUS_CLEANUP_FAILED
+	default:
+		return nil
+	}
+
+	q := `UPDATE pixel_streaming_instance SET status = $1, updated_at = now() WHERE id = $2 AND status = $3`
+
+	_, err = db.Exec(ctx, q, status, heartbeat.InstanceId, INSTANCE_STATUS_CLEANING)
+	if err != nil {
+		logrus.Errorf("failed to update %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update %s", PSInstanceSingular)
+	}
+
+	return nil
+}
+
+// LauncherDisconnect is sent by the launcher when the user of the session has dropped the connection.
+type LauncherDisconnect struct {
+	InstanceId *uuid.UUID `json:"instanceId"`
+	SessionId  *uuid.UUID `json:"sessionId"`
+}
+
+func handleLauncherDisconnect(w http.ResponseWriter, r *http.Request) {
+	var disconnect LauncherDisconnect
+	if !readJson(w, r, &disconnect) {
+		return
+	}
+
+	if disconnect.InstanceId == nil || disconnect.SessionId == nil {
+		writeError(w, http.StatusBadRequest, "instanceId and sessionId are required")
+		return
+	}
+
+	err := DisconnectSession(r.Context(), *disconnect.SessionId, *disconnect.InstanceId)
+	if errors.Is(err, ErrSessionNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,4 @@
+// Package launcherpb is the gRPC interface between launchers and the operator generated from launcher.proto.
+package launcherpb
+
+//go:generate buf generate --template buf.gen.yaml --path launcher.proto
@@ -0,0 +1,139 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: launcher.proto
+
+package launcherpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// LauncherServiceClient is the client API for LauncherService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type LauncherServiceClient interface {
+	// Connect opens the launcher stream, the first message must be Hello and the token is passed as "authorization: Bearer <token>" metadata.
+	Connect(ctx context.Context, opts ...grpc.CallOption) (LauncherService_ConnectClient, error)
+}
+
+type launcherServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLauncherServiceClient(cc grpc.ClientConnInterface) LauncherServiceClient {
+	return &launcherServiceClient{cc}
+}
+
+func (c *launcherServiceClient) Connect(ctx context.Context, opts ...grpc.CallOption) (LauncherService_ConnectClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LauncherService_ServiceDesc.Streams[0], "/veverse.pixelstreaming.launcher.v1.LauncherService/Connect", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &launcherServiceConnectClient{stream}
+	return x, nil
+}
+
+type LauncherService_ConnectClient interface {
+	Send(*LauncherMessage) error
+	Recv() (*OperatorCommand, error)
+	grpc.ClientStream
+}
+
+type launcherServiceConnectClient struct {
+	grpc.ClientStream
+}
+
+func (x *launcherServiceConnectClient) Send(m *LauncherMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *launcherServiceConnectClient) Recv() (*OperatorCommand, error) {
+	m := new(OperatorCommand)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LauncherServiceServer is the server API for LauncherService service.
+// All implementations must embed UnimplementedLauncherServiceServer
+// for forward compatibility
+type LauncherServiceServer interface {
+	// Connect opens the launcher stream, the first message must be Hello and the token is passed as "authorization: Bearer <token>" metadata.
+	Connect(LauncherService_ConnectServer) error
+	mustEmbedUnimplementedLauncherServiceServer()
+}
+
+// UnimplementedLauncherServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedLauncherServiceServer struct {
+}
+
+func (UnimplementedLauncherServiceServer) Connect(LauncherService_ConnectServer) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
+func (UnimplementedLauncherServiceServer) mustEmbedUnimplementedLauncherServiceServer() {}
+
+// UnsafeLauncherServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LauncherServiceServer will
+// result in compilation errors.
+type UnsafeLauncherServiceServer interface {
+	mustEmbedUnimplementedLauncherServiceServer()
+}
+
+func RegisterLauncherServiceServer(s grpc.ServiceRegistrar, srv LauncherServiceServer) {
+	s.RegisterService(&LauncherService_ServiceDesc, srv)
+}
+
+func _LauncherService_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LauncherServiceServer).Connect(&launcherServiceConnectServer{stream})
+}
+
+type LauncherService_ConnectServer interface {
+	Send(*OperatorCommand) error
+	Recv() (*LauncherMessage, error)
+	grpc.ServerStream
+}
+
+type launcherServiceConnectServer struct {
+	grpc.ServerStream
+}
+
+func (x *launcherServiceConnectServer) Send(m *OperatorCommand) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *launcherServiceConnectServer) Recv() (*LauncherMessage, error) {
+	m := new(LauncherMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LauncherService_ServiceDesc is the grpc.ServiceDesc for LauncherService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var LauncherService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "veverse.pixelstreaming.launcher.v1.LauncherService",
+	HandlerType: (*LauncherServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _LauncherService_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "launcher.proto",
+}
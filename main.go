@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"math/rand"
+	"os"
 	"time"
 )
 
@@ -16,6 +18,31 @@ func main() {
 
 	ctx := context.Background()
 
+	// release pools and rollouts are picked at random, each operator run picks differently
+	rand.Seed(time.Now().UnixNano())
+
+	if path := os.Getenv("OPERATOR_CONFIG"); path != "" {
+		if err := LoadConfig(path); err != nil {
+			Logger.Fatalf("failed to load config: %v", err)
+		}
+	}
+
+	if err := ValidateUserDataTemplates(); err != nil {
+		Logger.Fatalf("failed to validate user data: %v", err)
+	}
+
+	if err := ValidateCapacityProfiles(); err != nil {
+		Logger.Fatalf("failed to validate capacity profiles: %v", err)
+	}
+
+	if err := ValidateForecast(); err != nil {
+		Logger.Fatalf("failed to validate forecast: %v", err)
+	}
+
+	if err := ValidateScaling(); err != nil {
+		Logger.Fatalf("failed to validate scaling: %v", err)
+	}
+
 	//region Database
 	var err error
 	ctx, err = DatabaseOpen(ctx)
@@ -30,7 +57,57 @@ func main() {
 		}
 	}(ctx)
 
+	if len(os.Args) > 1 && os.Args[1] == "usage" {
+		err = RunUsageCommand(ctx, os.Args[2:])
+		if err != nil {
+			Logger.Errorf("failed to query usage: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "forecast" {
+		err = RunForecastCommand(ctx, os.Args[2:])
+		if err != nil {
+			Logger.Errorf("failed to query forecasts: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rollback" {
+		err = RunRollbackCommand(ctx, os.Args[2:])
+		if err != nil {
+			Logger.Errorf("failed to roll back: %v", err)
+		}
+		return
+	}
+
+	go func() {
+		err := ServeApi(ctx)
+		if err != nil {
+			Logger.Fatalf("failed to serve api: %v", err)
+		}
+	}()
+
+	go func() {
+		err := ServeGrpc(ctx)
+		if err != nil {
+			Logger.Fatalf("failed to serve grpc: %v", err)
+		}
+	}()
+
 	for {
+		err = EnforceSessionTimeouts(ctx)
+		if err != nil {
+			Logger.Errorf("failed to enforce session timeouts: %v", err)
+			return
+		}
+
+		err = ReconcileRollouts(ctx)
+		if err != nil {
+			Logger.Errorf("failed to reconcile rollouts: %v", err)
+			return
+		}
+
 		err = CheckAvailabilitySpotInstance(ctx)
 		if err != nil {
 			Logger.Errorf("failed to check spot availability instance: %v", err)
@@ -43,15 +120,39 @@ func main() {
 			return
 		}
 
+		err = UpdateStartingInstances(ctx)
+		if err != nil {
+			Logger.Errorf("failed to update starting instance: %v", err)
+			return
+		}
+
 		err = UpdateOccupiedInstance(ctx)
 		if err != nil {
 			Logger.Errorf("failed to update occupied instance: %v", err)
 			return
 		}
 
-		err = TerminateClosedSessionsInstance(ctx)
+		err = ReleaseClosedSessionsInstance(ctx)
+		if err != nil {
+			Logger.Errorf("failed to release closed session instance: %v", err)
+			return
+		}
+
+		err = CompleteDrainingInstances(ctx)
+		if err != nil {
+			Logger.Errorf("failed to complete draining instances: %v", err)
+			return
+		}
+
+		err = RecordSessionUsage(ctx)
+		if err != nil {
+			Logger.Errorf("failed to record session usage: %v", err)
+			return
+		}
+
+		err = RecordForecasts(ctx)
 		if err != nil {
-			Logger.Errorf("failed to terminate closed session instance: %v", err)
+			Logger.Errorf("failed to record forecasts: %v", err)
 			return
 		}
 
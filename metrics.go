@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricFamily is a gauge written in the Prometheus text format.
+type metricFamily struct {
+	Name    string
+	Help    string
+	Samples []metricSample
+}
+
+type metricSample struct {
+	Labels [][2]string // label names and values in order
+	Value  float64
+}
+
+// CollectMetrics returns the gauges of the operator at the time.
+func CollectMetrics(ctx context.Context, now time.Time) (families []metricFamily, err error) {
+	var statuses []CapacityStatus
+	statuses, err = GetCapacityStatus(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := metricFamily{Name: "pixel_streaming_capacity_profile_active", Help: "Capacity profile active for the pool in the region."}
+	freeSlots := metricFamily{Name: "pixel_streaming_free_slots_target", Help: "Free slots the pool keeps in the region."}
+	demand := metricFamily{Name: "pixel_streaming_free_slots_demand", Help: "Free slots the sessions arriving while an instance of the target-tracking pool boots need in the region."}
+	forecast := metricFamily{Name: "pixel_streaming_free_slots_forecast", Help: "Free slots the pool needs in the region for the forecast sessions."}
+
+	for _, status := range statuses {
+		labels := capacityMetricLabels(status)
+		if status.Profile != "" {
+			profiles.Samples = append(profiles.Samples, metricSample{Labels: append(labels, [2]string{"profile", status.Profile}), Value: 1})
+		}
+
+		for _, instanceType := range []string{"spot", "on-demand"} {
+			freeSlots.Samples = append(freeSlots.Samples, metricSample{
+				Labels: append(labels, [2]string{"instance_type", instanceType}),
+				Value:  float64(status.FreeSlots[instanceType]),
+			})
+
+			if value, ok := status.Demand[instanceType]; ok {
+				demand.Samples = append(demand.Samples, metricSample{Labels: append(labels, [2]string{"instance_type", instanceType}), Value: value})
+			}
+
+			if value, ok := status.Forecast[instanceType]; ok {
+				forecast.Samples = append(forecast.Samples, metricSample{Labels: append(labels, [2]string{"instance_type", instanceType}), Value: value})
+			}
+		}
+	}
+
+	return []metricFamily{profiles, freeSlots, demand, forecast}, nil
+}
+
+// capacityMetricLabels returns the labels of the pool in the region, the default pool has an empty release.
+func capacityMetricLabels(status CapacityStatus) [][2]string {
+	release := ""
+	if status.ReleaseId != nil {
+		release = status.ReleaseId.String()
+	}
+
+	return [][2]string{{"region", status.Region}, {"release", release}, {"platform", status.Platform}}
+}
+
+// WriteMetrics writes the gauges in the Prometheus text format.
+func WriteMetrics(w io.Writer, families []metricFamily) error {
+	for _, family := range families {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", family.Name, family.Help, family.Name); err != nil {
+			return err
+		}
+
+		for _, sample := range family.Samples {
+			var labels []string
+			for _, label := range sample.Labels {
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, label[0], metricLabelEscaper.Replace(label[1])))
+			}
+
+			if _, err := fmt.Fprintf(w, "%s{%s} %s\n", family.Name, strings.Join(labels, ","), strconv.FormatFloat(sample.Value, 'g', -1, 64)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	families, err := CollectMetrics(r.Context(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = WriteMetrics(w, families)
+}
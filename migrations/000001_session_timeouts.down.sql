@@ -0,0 +1,3 @@
+ALTER TABLE pixel_streaming_sessions
+    DROP COLUMN IF EXISTS last_input_at,
+    DROP COLUMN IF EXISTS end_reason;
@@ -0,0 +1,3 @@
+ALTER TABLE pixel_streaming_sessions
+    ADD COLUMN IF NOT EXISTS end_reason    text,
+    ADD COLUMN IF NOT EXISTS last_input_at timestamptz;
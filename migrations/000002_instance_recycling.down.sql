@@ -0,0 +1,5 @@
+ALTER TABLE pixel_streaming_sessions
+    DROP COLUMN IF EXISTS released_at;
+
+ALTER TABLE pixel_streaming_instance
+    DROP COLUMN IF EXISTS session_count;
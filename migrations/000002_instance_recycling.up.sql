@@ -0,0 +1,7 @@
+ALTER TABLE pixel_streaming_instance
+    ADD COLUMN IF NOT EXISTS session_count integer     NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS created_at    timestamptz NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS updated_at    timestamptz NOT NULL DEFAULT now();
+
+ALTER TABLE pixel_streaming_sessions
+    ADD COLUMN IF NOT EXISTS released_at timestamptz;
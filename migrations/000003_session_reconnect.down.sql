@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS pixel_streaming_sessions_reconnect_token_key;
+
+ALTER TABLE pixel_streaming_sessions
+    DROP COLUMN IF EXISTS reconnect_token,
+    DROP COLUMN IF EXISTS disconnected_at;
@@ -0,0 +1,6 @@
+ALTER TABLE pixel_streaming_sessions
+    ADD COLUMN IF NOT EXISTS user_id         uuid,
+    ADD COLUMN IF NOT EXISTS disconnected_at timestamptz,
+    ADD COLUMN IF NOT EXISTS reconnect_token text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS pixel_streaming_sessions_reconnect_token_key ON pixel_streaming_sessions (reconnect_token);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS pixel_streaming_usage;
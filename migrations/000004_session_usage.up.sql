@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS pixel_streaming_usage
+(
+    session_id     uuid PRIMARY KEY,
+    user_id        uuid,
+    app_id         uuid,
+    release_id     uuid,
+    region_id      uuid,
+    instance_type  text,
+    started_at     timestamptz      NOT NULL,
+    ended_at       timestamptz      NOT NULL,
+    duration       bigint           NOT NULL,
+    end_reason     text,
+    estimated_cost double precision NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS pixel_streaming_usage_started_at_idx ON pixel_streaming_usage (started_at);
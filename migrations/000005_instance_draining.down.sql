@@ -0,0 +1,3 @@
+ALTER TABLE pixel_streaming_instance
+    DROP COLUMN IF EXISTS drain_deadline,
+    DROP COLUMN IF EXISTS drained_at;
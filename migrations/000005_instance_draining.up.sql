@@ -0,0 +1,3 @@
+ALTER TABLE pixel_streaming_instance
+    ADD COLUMN IF NOT EXISTS drained_at     timestamptz,
+    ADD COLUMN IF NOT EXISTS drain_deadline timestamptz;
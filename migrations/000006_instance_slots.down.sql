@@ -0,0 +1,5 @@
+ALTER TABLE pixel_streaming_sessions
+    DROP COLUMN IF EXISTS slot;
+
+ALTER TABLE pixel_streaming_instance
+    DROP COLUMN IF EXISTS slots;
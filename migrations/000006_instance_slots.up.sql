@@ -0,0 +1,5 @@
+ALTER TABLE pixel_streaming_instance
+    ADD COLUMN IF NOT EXISTS slots integer NOT NULL DEFAULT 1;
+
+ALTER TABLE pixel_streaming_sessions
+    ADD COLUMN IF NOT EXISTS slot integer;
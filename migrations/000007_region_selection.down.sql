@@ -0,0 +1,8 @@
+ALTER TABLE pixel_streaming_sessions
+    DROP COLUMN IF EXISTS region_id;
+
+ALTER TABLE region
+    DROP COLUMN IF EXISTS ping_url,
+    DROP COLUMN IF EXISTS continent,
+    DROP COLUMN IF EXISTS longitude,
+    DROP COLUMN IF EXISTS latitude;
@@ -0,0 +1,8 @@
+ALTER TABLE region
+    ADD COLUMN IF NOT EXISTS latitude  double precision,
+    ADD COLUMN IF NOT EXISTS longitude double precision,
+    ADD COLUMN IF NOT EXISTS continent text,
+    ADD COLUMN IF NOT EXISTS ping_url  text;
+
+ALTER TABLE pixel_streaming_sessions
+    ADD COLUMN IF NOT EXISTS region_id uuid;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS pixel_streaming_rollout
+(
+    app_id              uuid PRIMARY KEY,
+    release_id          uuid        NOT NULL,
+    previous_release_id uuid,
+    percentage          integer     NOT NULL DEFAULT 0,
+    status              text        NOT NULL,
+    started_at          timestamptz NOT NULL DEFAULT now(),
+    created_at          timestamptz NOT NULL DEFAULT now(),
+    updated_at          timestamptz NOT NULL DEFAULT now()
+);
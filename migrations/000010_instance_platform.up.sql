@@ -0,0 +1,3 @@
+-- NULL is windows, the platform of the instances launched before
+ALTER TABLE pixel_streaming_instance
+    ADD COLUMN IF NOT EXISTS platform text;
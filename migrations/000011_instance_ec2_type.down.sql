@@ -0,0 +1,2 @@
+ALTER TABLE pixel_streaming_instance
+    DROP COLUMN IF EXISTS ec2_instance_type;
@@ -0,0 +1,3 @@
+ALTER TABLE pixel_streaming_instance
+    DROP COLUMN IF EXISTS availability_zone,
+    DROP COLUMN IF EXISTS subnet_id;
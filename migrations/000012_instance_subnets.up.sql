@@ -0,0 +1,3 @@
+ALTER TABLE pixel_streaming_instance
+    ADD COLUMN IF NOT EXISTS subnet_id         text,
+    ADD COLUMN IF NOT EXISTS availability_zone text;
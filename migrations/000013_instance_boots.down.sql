@@ -0,0 +1,5 @@
+ALTER TABLE pixel_streaming_instance
+    DROP COLUMN IF EXISTS boot_seconds,
+    DROP COLUMN IF EXISTS boot_started_at,
+    DROP COLUMN IF EXISTS boot_kind,
+    DROP COLUMN IF EXISTS hibernated;
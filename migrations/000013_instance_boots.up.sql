@@ -0,0 +1,5 @@
+ALTER TABLE pixel_streaming_instance
+    ADD COLUMN IF NOT EXISTS hibernated      boolean NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS boot_kind       text,
+    ADD COLUMN IF NOT EXISTS boot_started_at timestamptz,
+    ADD COLUMN IF NOT EXISTS boot_seconds    double precision;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS pixel_streaming_forecast
+(
+    region_id    uuid             NOT NULL,
+    app_key      text             NOT NULL, -- app id or default
+    window_start timestamptz      NOT NULL,
+    window_end   timestamptz      NOT NULL,
+    forecast     double precision NOT NULL,
+    created_at   timestamptz      NOT NULL DEFAULT now(),
+    UNIQUE (region_id, app_key, window_start)
+);
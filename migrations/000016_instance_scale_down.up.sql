@@ -0,0 +1,2 @@
+ALTER TABLE pixel_streaming_instance
+    ADD COLUMN IF NOT EXISTS scaled_down_at timestamptz;
@@ -0,0 +1,2 @@
+ALTER TABLE pixel_streaming_sessions
+    DROP COLUMN IF EXISTS assigned_at;
@@ -0,0 +1,2 @@
+ALTER TABLE pixel_streaming_sessions
+    ADD COLUMN IF NOT EXISTS assigned_at timestamptz;
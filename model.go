@@ -112,26 +112,78 @@ type App struct {
 
 type Region struct {
 	Entity
-	Name string `json:"name,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	Continent *string  `json:"continent,omitempty"` // GeoIP continent code, e.g. EU
+	PingUrl   *string  `json:"pingUrl,omitempty"`   // endpoint the client measures its RTT to
 }
 
 type PixelStreamingInstance struct {
 	Entity
 
-	InstanceId *string    `json:"instanceId,omitempty"`
-	ReleaseId  *uuid.UUID `json:"releaseId,omitempty"`
-	RegionId   *uuid.UUID `json:"regionId,omitempty"`
-	Host       *string    `json:"host,omitempty"`
-	Port       *uint16    `json:"port,omitempty"`
-	Status     *string    `json:"status,omitempty"`
+	InstanceId   *string    `json:"instanceId,omitempty"`
+	ReleaseId    *uuid.UUID `json:"releaseId,omitempty"`
+	RegionId     *uuid.UUID `json:"regionId,omitempty"`
+	Host         *string    `json:"host,omitempty"`
+	Port         *uint16    `json:"port,omitempty"`
+	Status       *string    `json:"status,omitempty"`
+	InstanceType *string    `json:"instanceType,omitempty"`
+	SessionCount *int32     `json:"sessionCount,omitempty"`
+	Slots        *int32     `json:"slots,omitempty"` // sessions the instance runs at once on consecutive ports starting at Port
+	Platform     *string    `json:"platform,omitempty"`
+	Ec2Type      *string    `json:"ec2InstanceType,omitempty"` // EC2 instance type the instance has been launched with, InstanceType is spot or on-demand
+	SubnetId     *string    `json:"subnetId,omitempty"`
+	Zone         *string    `json:"availabilityZone,omitempty"`
+	BootKind     *string    `json:"bootKind,omitempty"`    // launch, start or resume
+	BootSeconds  *float64   `json:"bootSeconds,omitempty"` // time the last boot took until the instance was free
+}
+
+type PixelStreamingInstanceFilter struct {
+	RegionId     *uuid.UUID
+	InstanceType *string
+	Status       *string
+	ReleaseId    *uuid.UUID
+	Limit        int
 }
 
 type PixelStreamingInstanceMetadata struct {
 	Id           *uuid.UUID `json:"id"`
 	RegionId     *uuid.UUID `json:"regionId"`
+	ReleaseId    *uuid.UUID `json:"releaseId,omitempty"`
 	Host         *string    `json:"host,omitempty"`
 	Port         *uint16    `json:"port,omitempty"`
 	Status       *string    `json:"status,omitempty"`
 	InstanceId   *string    `json:"instanceId,omitempty"`
 	InstanceType *string    `json:"instanceType"`
+	Slots        *int32     `json:"slots,omitempty"`
+	Platform     *string    `json:"platform,omitempty"`
+	Ec2Type      *string    `json:"ec2InstanceType,omitempty"`
+}
+
+type PixelStreamingSession struct {
+	Identifier
+
+	UserId         *uuid.UUID `json:"userId,omitempty"`
+	AppId          *uuid.UUID `json:"appId,omitempty"`
+	ReleaseId      *uuid.UUID `json:"releaseId,omitempty"`
+	WorldId        *uuid.UUID `json:"worldId,omitempty"`
+	RegionId       *uuid.UUID `json:"regionId,omitempty"`
+	InstanceId     *uuid.UUID `json:"instanceId,omitempty"`
+	Slot           *int32     `json:"slot,omitempty"`
+	Status         *string    `json:"status,omitempty"`
+	EndReason      *string    `json:"endReason,omitempty"`
+	LastInputAt    *time.Time `json:"lastInputAt,omitempty"`
+	DisconnectedAt *time.Time `json:"disconnectedAt,omitempty"`
+	ReconnectToken *string    `json:"reconnectToken,omitempty"` // only returned to the backend creating the session
+
+	Timestamps
+}
+
+type PixelStreamingSessionFilter struct {
+	Status     *string
+	AppId      *uuid.UUID
+	InstanceId *uuid.UUID
+	UserId     *uuid.UUID
+	Limit      int
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/gofrs/uuid"
+	"net/http"
+)
+
+// OpenApiDocument describes the operator HTTP API, the client package is generated from it.
+//
+//go:embed openapi.json
+var OpenApiDocument []byte
+
+// NewOpenApiRouter loads and validates the embedded OpenAPI document.
+func NewOpenApiRouter(ctx context.Context) (routers.Router, error) {
+	openapi3.SchemaErrorDetailsDisabled = true
+	openapi3.DefineStringFormatCallback("uuid", func(value string) error {
+		_, err := uuid.FromString(value)
+		return err
+	})
+
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(OpenApiDocument)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load openapi document: %v", err)
+	}
+
+	if err = doc.Validate(ctx); err != nil {
+		return nil, fmt.Errorf("invalid openapi document: %v", err)
+	}
+
+	// requests are matched by path only, the servers of the document are not checked
+	doc.Servers = nil
+
+	return legacy.NewRouter(doc)
+}
+
+// validateRequest rejects requests which do not match the OpenAPI document, unknown routes are passed to the mux.
+// Authentication is left to requireToken.
+func validateRequest(router routers.Router, next http.Handler) http.Handler {
+	options := &openapi3filter.Options{
+		AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := router.FindRoute(r)
+		if err != nil {
+			if err.Error() == routers.ErrMethodNotAllowed.Error() {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			} else {
+				next.ServeHTTP(w, r)
+			}
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    options,
+		}
+
+		if err = openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleOpenApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(OpenApiDocument)
+}
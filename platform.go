@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+const (
+	PLATFORM_WINDOWS = "windows"
+	PLATFORM_LINUX   = "linux"
+
+	LINUX_SPOT_LAUNCH_TEMPLATE_ID      = "lt-xxxxxxxxxxxxxxxxx"
+	LINUX_ON_DEMAND_LAUNCH_TEMPLATE_ID = "lt-xxxxxxxxxxxxxxxxx"
+
+	// FILE_DEPLOYMENT_CLIENT is the deployment of the release files streamed to the users
+	FILE_DEPLOYMENT_CLIENT = "client"
+)
+
+var (
+	// Platforms lists the platforms pools can run, windows is preferred when a release has builds for several
+	Platforms = []string{PLATFORM_WINDOWS, PLATFORM_LINUX}
+
+	platformNames     = map[string]string{PLATFORM_WINDOWS: "Windows", PLATFORM_LINUX: "Linux"}
+	instanceTypeNames = map[string]string{"spot": "Spot", "on-demand": "OnDemand"}
+)
+
+// NormalizePlatform maps the platform of a release file (e.g. Win64, Linux) to a pool platform, empty if it is not supported.
+func NormalizePlatform(platform string) string {
+	switch p := strings.ToLower(platform); {
+	case p == PLATFORM_WINDOWS || strings.HasPrefix(p, "win"):
+		return PLATFORM_WINDOWS
+	case strings.HasPrefix(p, PLATFORM_LINUX):
+		return PLATFORM_LINUX
+	}
+
+	return ""
+}
+
+// Platform returns the launch settings of the platform.
+func (c *OperatorConfig) Platform(platform string) PlatformConfig {
+	return c.Platforms[platform]
+}
+
+// InstanceName returns the Name tag of the instances of the pool, e.g. VeVerse-PixelStreaming-Linux-Spot.
+func (p InstancePool) InstanceName(instanceType string) string {
+	return fmt.Sprintf("VeVerse-PixelStreaming-%s-%s", platformNames[p.Platform], instanceTypeNames[instanceType])
+}
+
+// GetReleasePlatforms returns the pool platforms of the client builds of the releases.
+func GetReleasePlatforms(ctx context.Context, releaseIds []uuid.UUID) (platforms map[uuid.UUID][]string, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT DISTINCT entity_id, platform FROM files WHERE entity_id = ANY($1) AND deployment_type = $2 AND platform IS NOT NULL`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, releaseIds, FILE_DEPLOYMENT_CLIENT)
+	if err != nil {
+		logrus.Errorf("failed to query release files @ %s: %v", reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get release files")
+	}
+	defer rows.Close()
+
+	platforms = make(map[uuid.UUID][]string)
+	for rows.Next() {
+		var (
+			releaseId uuid.UUID
+			platform  string
+		)
+
+		err = rows.Scan(&releaseId, &platform)
+		if err != nil {
+			logrus.Errorf("failed to scan release files @ %s: %v", reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get release files")
+		}
+
+		if p := NormalizePlatform(platform); p != "" {
+			platforms[releaseId] = append(platforms[releaseId], p)
+		}
+	}
+
+	return platforms, nil
+}
+
+// releasePlatform picks the platform of the release pool out of the platforms of its client builds.
+func releasePlatform(platforms []string) string {
+	for _, platform := range Platforms {
+		for _, p := range platforms {
+			if p == platform {
+				return platform
+			}
+		}
+	}
+
+	return Config.DefaultPlatform
+}
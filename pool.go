@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"math/rand"
+	"sort"
+)
+
+// RELEASE_TAG is the EC2 tag holding the release id of the instances launched for a release pool.
+const RELEASE_TAG = "PixelStreamingReleaseId"
+
+// InstancePool is the set of instances launched from the same image, instances of the default pool have no release.
+type InstancePool struct {
+	ReleaseId         *uuid.UUID
+	AppId             *uuid.UUID
+	Version           string // release version the images are looked up by
+	Platform          string // windows or linux
+	ImageId           string // image new instances are launched from, configured or resolved in the region by ResolvePoolImages
+	ImageIds          []string
+	ExtraImageTags    map[string]string
+	LaunchTemplateIds map[string]string
+	InstanceTypes     map[string][]InstanceTypeOption
+	Subnets           map[string][]SubnetConfig // keyed by region name
+	Scaling           *ScalingConfig            // scaling of the release, the scaling of the operator if nil
+	Weight            int32                     // percentage of the new sessions of its app the pool receives, its warm capacity is sized by it
+}
+
+// GetInstancePools returns the pools of the configured releases, preceded by the default pool if it is enabled.
+// Releases retired by the rollout of their app have no pool, the weight of a pool comes from the release weights or the rollout of its app.
+// Pools SelectRelease never picks have weight 0, they keep no warm instances.
+func GetInstancePools(ctx context.Context) (pools []InstancePool, err error) {
+	if Config.DefaultPool {
+		pools = append(pools, InstancePool{Platform: Config.DefaultPlatform, Weight: 100})
+	}
+
+	releasePools, err := getReleasePools(ctx)
+	if err != nil || len(releasePools) == 0 {
+		return pools, err
+	}
+
+	rollouts, err := GetRollouts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	appPools := make(map[uuid.UUID]int)
+	for _, pool := range releasePools {
+		appPools[*pool.AppId]++
+	}
+
+	for _, pool := range releasePools {
+		app := Config.App(pool.AppId)
+		rollout, ok := rollouts[*pool.AppId]
+
+		switch {
+		case len(app.ReleaseWeights) > 0 && app.ReleaseId == "":
+			// the same weights split the new sessions in SelectRelease
+			pool.Weight = releaseWeightPercentage(releasePools, *pool.AppId, *pool.ReleaseId)
+		case app.ReleaseId != "":
+			// sessions of an app pinned to a release only use its pool
+			if pinned, err := uuid.FromString(app.ReleaseId); err != nil || pinned != *pool.ReleaseId {
+				pool.Weight = 0
+			}
+		case !ok:
+			// without a rollout the sessions of an app with several pools use the default pool
+			if appPools[*pool.AppId] > 1 {
+				pool.Weight = 0
+			}
+		case !slices.Contains(rollout.PoolReleaseIds(), *pool.ReleaseId):
+			continue
+		default:
+			pool.Weight = rollout.Weight(*pool.ReleaseId)
+		}
+
+		pools = append(pools, pool)
+	}
+
+	return pools, nil
+}
+
+// getReleasePools returns the pools of all configured releases sorted by release id.
+func getReleasePools(ctx context.Context) (pools []InstancePool, err error) {
+	if len(Config.Releases) == 0 {
+		return nil, nil
+	}
+
+	releases, err := GetReleases(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get releases: %v", err)
+	}
+
+	for id, releasePool := range Config.Releases {
+		releaseId, err := uuid.FromString(id)
+		if err != nil {
+			logrus.Warnf("invalid release id %s in the release pools", id)
+			continue
+		}
+
+		var release *Release
+		for i := range releases {
+			if releases[i].Id != nil && *releases[i].Id == releaseId {
+				release = &releases[i]
+				break
+			}
+		}
+
+		if release == nil || release.AppId == nil {
+			logrus.Warnf("release %s of the release pools does not exist", id)
+			continue
+		}
+
+		pools = append(pools, InstancePool{
+			ReleaseId:         &releaseId,
+			AppId:             release.AppId,
+			Version:           release.Version,
+			Platform:          NormalizePlatform(releasePool.Platform),
+			ImageId:           releasePool.ImageId,
+			ExtraImageTags:    releasePool.ImageTags,
+			LaunchTemplateIds: releasePool.LaunchTemplateIds,
+			InstanceTypes:     releasePool.InstanceTypes,
+			Subnets:           releasePool.Subnets,
+			Scaling:           releasePool.Scaling,
+			Weight:            100,
+		})
+	}
+
+	// releases without a configured platform run the platform of their client build
+	var detect []uuid.UUID
+	for _, pool := range pools {
+		if pool.Platform == "" {
+			detect = append(detect, *pool.ReleaseId)
+		}
+	}
+
+	if len(detect) > 0 {
+		platforms, err := GetReleasePlatforms(ctx, detect)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range pools {
+			if pools[i].Platform == "" {
+				pools[i].Platform = releasePlatform(platforms[*pools[i].ReleaseId])
+			}
+		}
+	}
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].ReleaseId.String() < pools[j].ReleaseId.String()
+	})
+
+	return pools, nil
+}
+
+// LaunchTemplateId returns the launch template of the pool for the instance type, the launch template of its platform if the release has none.
+func (p InstancePool) LaunchTemplateId(instanceType string) string {
+	if id := p.LaunchTemplateIds[instanceType]; id != "" {
+		return id
+	}
+
+	return Config.Platform(p.Platform).LaunchTemplateIds[instanceType]
+}
+
+// InstanceTypeOptions returns the EC2 instance types the pool launches in order of preference, those of its platform if the release has none.
+// Options without a weight take the slots of the instance type.
+func (p InstancePool) InstanceTypeOptions(instanceType string) (options []InstanceTypeOption) {
+	configured := p.InstanceTypes[instanceType]
+	if len(configured) == 0 {
+		configured = Config.Platform(p.Platform).InstanceTypes[instanceType]
+	}
+
+	for _, option := range configured {
+		if option.Weight <= 0 {
+			option.Weight = Config.InstanceSlots(instanceType)
+		}
+		options = append(options, option)
+	}
+
+	return options
+}
+
+// Slots returns the slots of an instance of the preferred instance type, the planner counts new instances with it.
+func (p InstancePool) Slots(instanceType string) int {
+	if options := p.InstanceTypeOptions(instanceType); len(options) > 0 {
+		return options[0].Weight
+	}
+
+	return Config.InstanceSlots(instanceType)
+}
+
+// FreeSlots returns the free slots of the instance type the pool keeps in each region, scaled by its weight and rounded up.
+func (p InstancePool) FreeSlots(instanceType string) int32 {
+	return p.scale(Config.FreeSlots[instanceType])
+}
+
+// StoppedInstances returns the stopped on-demand instances the pool keeps in each region, scaled by its weight and rounded up.
+func (p InstancePool) StoppedInstances() int32 {
+	return p.scale(STOPPED_ON_DEMAND_AVAILABLE)
+}
+
+func (p InstancePool) scale(count int32) int32 {
+	if p.Weight <= 0 || count <= 0 {
+		return 0
+	}
+
+	return (count*p.Weight + 99) / 100
+}
+
+// Filters returns the EC2 filters matching the instances of the pool, the images of the pool are resolved first. Pools whose images
+// could not be resolved are matched by their launch template and release only.
+func (p InstancePool) Filters(instanceType string) []types.Filter {
+	filters := []types.Filter{
+		NewEC2Filter("tag:aws:ec2launchtemplate:id", p.LaunchTemplateId(instanceType)),
+	}
+
+	if len(p.ImageIds) > 0 {
+		filters = append(filters, NewEC2Filter("image-id", p.ImageIds...))
+	}
+
+	if p.ReleaseId != nil {
+		filters = append(filters, NewEC2Filter("tag:"+RELEASE_TAG, p.ReleaseId.String()))
+	}
+
+	return filters
+}
+
+// RunInstancesInput returns a copy of the input launching the image and launch template of the pool and its platform,
+// instances are named after the platform and tagged with the platform and the release.
+func (p InstancePool) RunInstancesInput(input *ec2.RunInstancesInput, instanceType string) *ec2.RunInstancesInput {
+	r := *input
+	r.ImageId = aws.String(p.ImageId)
+	r.LaunchTemplate = &types.LaunchTemplateSpecification{
+		LaunchTemplateId: aws.String(p.LaunchTemplateId(instanceType)),
+	}
+
+	r.TagSpecifications = nil
+	for _, spec := range input.TagSpecifications {
+		var tags []types.Tag
+		for _, tag := range spec.Tags {
+			if aws.ToString(tag.Key) == "Name" {
+				tag.Value = aws.String(p.InstanceName(instanceType))
+			}
+			tags = append(tags, tag)
+		}
+
+		tags = append(tags, types.Tag{Key: aws.String(IMAGE_PLATFORM_TAG), Value: aws.String(p.Platform)})
+		if p.ReleaseId != nil {
+			tags = append(tags, types.Tag{Key: aws.String(RELEASE_TAG), Value: aws.String(p.ReleaseId.String())})
+		}
+
+		spec.Tags = tags
+		r.TagSpecifications = append(r.TagSpecifications, spec)
+	}
+
+	return &r
+}
+
+// hasPool reports whether the release, nil for the default pool, has one of the pools.
+func hasPool(pools []InstancePool, releaseId *uuid.UUID) bool {
+	for _, pool := range pools {
+		if pool.ReleaseId == nil && releaseId == nil || pool.ReleaseId != nil && releaseId != nil && *pool.ReleaseId == *releaseId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SelectRelease returns the release pool new sessions of the app use, the release weights or else the rollout of the app split them between its pools.
+// Sessions without a release pool use the default pool.
+func SelectRelease(ctx context.Context, appId *uuid.UUID) (releaseId *uuid.UUID, err error) {
+	if appId == nil {
+		return nil, nil
+	}
+
+	app := Config.App(appId)
+	if id := app.ReleaseId; id != "" {
+		configured, err := uuid.FromString(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid release id %s of app %s", id, appId)
+		}
+
+		return &configured, nil
+	}
+
+	var pools []InstancePool
+	pools, err = GetInstancePools(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rollouts map[uuid.UUID]Rollout
+	rollouts, err = GetRollouts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(app.ReleaseWeights) > 0 {
+		if picked := pickWeightedRelease(pools, *appId); picked != nil {
+			return picked, nil
+		}
+
+		logrus.Warnf("app %s has no release pool with a weight, using the default pool", appId)
+		return nil, nil
+	}
+
+	// the rollout is ignored once the pool it picks is no longer configured
+	if rollout, ok := rollouts[*appId]; ok {
+		if picked := rollout.PickRelease(); hasPool(pools, picked) {
+			return picked, nil
+		}
+	}
+
+	for _, pool := range pools {
+		if pool.AppId == nil || *pool.AppId != *appId {
+			continue
+		}
+
+		if releaseId != nil {
+			logrus.Warnf("app %s has several release pools but no releaseId configured, using the default pool", appId)
+			return nil, nil
+		}
+
+		releaseId = pool.ReleaseId
+	}
+
+	return releaseId, nil
+}
+
+// releaseWeightPercentage returns the share of the new sessions of the app pickWeightedRelease gives the release in percent, rounded up so
+// a small canary keeps a pool.
+func releaseWeightPercentage(pools []InstancePool, appId uuid.UUID, releaseId uuid.UUID) int32 {
+	candidates, total := weightedReleases(pools, appId)
+	for _, candidate := range candidates {
+		if *candidate == releaseId {
+			weight := Config.App(&appId).ReleaseWeights[releaseId.String()]
+			return (weight*100 + total - 1) / total
+		}
+	}
+
+	return 0
+}
+
+// weightedReleases returns the release pools of the app with a positive release weight and the sum of their weights.
+func weightedReleases(pools []InstancePool, appId uuid.UUID) (candidates []*uuid.UUID, total int32) {
+	weights := Config.App(&appId).ReleaseWeights
+
+	for _, pool := range pools {
+		if pool.AppId == nil || *pool.AppId != appId || weights[pool.ReleaseId.String()] <= 0 {
+			continue
+		}
+
+		candidates = append(candidates, pool.ReleaseId)
+		total += weights[pool.ReleaseId.String()]
+	}
+
+	return candidates, total
+}
+
+// pickWeightedRelease picks one of the weighted release pools of the app at random in proportion to the weights.
+func pickWeightedRelease(pools []InstancePool, appId uuid.UUID) *uuid.UUID {
+	weights := Config.App(&appId).ReleaseWeights
+
+	candidates, total := weightedReleases(pools, appId)
+	if total <= 0 {
+		return nil
+	}
+
+	n := rand.Int31n(total)
+	for _, releaseId := range candidates {
+		n -= weights[releaseId.String()]
+		if n < 0 {
+			return releaseId
+		}
+	}
+
+	return nil
+}
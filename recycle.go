@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"time"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+type releasedInstance struct {
+	SessionId    uuid.UUID
+	Id           uuid.UUID
+	InstanceId   *string
+	InstanceType string
+	Status       string
+	SessionCount int
+	CreatedAt    *time.Time
+	Active       int // sessions still running in the other slots of the instance
+}
+
+// ShouldRecycle reports whether the instance can serve another session after sessionCount sessions.
+func (p RecyclePolicy) ShouldRecycle(sessionCount int, createdAt *time.Time, now time.Time) bool {
+	if !p.Recycle {
+		return false
+	}
+
+	if p.MaxSessions > 0 && sessionCount >= p.MaxSessions {
+		return false
+	}
+
+	if p.MaxAge.Duration > 0 && createdAt != nil && now.Sub(*createdAt) > p.MaxAge.Duration {
+		return false
+	}
+
+	return true
+}
+
+// ReleaseClosedSessionsInstance hands the instances of closed sessions to the launcher for cleanup or terminates them according to the recycle policy,
+// instances which failed or did not finish the cleanup in time are terminated. Draining instances are left to CompleteDrainingInstances.
+// Instances with sessions left in other slots keep running, the launcher cleans up the slot of the closed session.
+func ReleaseClosedSessionsInstance(ctx context.Context) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	var regions map[uuid.UUID]string
+	regions, err = GetRegions(ctx)
+	if err != nil {
+		return err
+	}
+
+	for regionId, regionName := range regions {
+		q := `SELECT
+	pss.id, psi.id, psi.instance_id, psi.instance_type, psi.status, psi.session_count, psi.created_at,
+	(SELECT COUNT(*) FROM pixel_streaming_sessions a WHERE a.instance_id = psi.id AND a.status = ANY($4)) AS active
+FROM
+	pixel_streaming_sessions pss
+	INNER JOIN pixel_streaming_instance psi ON psi.id = pss.instance_id AND psi.region_id = $1
+WHERE
+	pss.status = $2
+	AND pss.released_at IS NULL
+	AND psi.status = ANY($3)`
+
+		var rows pgx.Rows
+		rows, err = db.Query(ctx, q, regionId, SESSION_STATUS_CLOSED, []string{INSTANCE_STATUS_FREE, INSTANCE_STATUS_OCCUPIED, INSTANCE_STATUS_DRAINING}, ActiveSessionStatuses)
+		if err != nil {
+			logrus.Errorf("failed to query %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return fmt.Errorf("failed to get %s", PSInstancePlural)
+		}
+
+		var released []releasedInstance
+		for rows.Next() {
+			var r releasedInstance
+			err = rows.Scan(&r.SessionId, &r.Id, &r.InstanceId, &r.InstanceType, &r.Status, &r.SessionCount, &r.CreatedAt, &r.Active)
+			if err != nil {
+				rows.Close()
+				logrus.Errorf("failed to scan %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+				return fmt.Errorf("failed to get %s", PSInstancePlural)
+			}
+
+			released = append(released, r)
+		}
+		rows.Close()
+
+		var (
+			now                  = time.Now()
+			sessionIds           []uuid.UUID
+			terminateInstanceIds []string
+		)
+
+		for _, r := range released {
+			sessionIds = append(sessionIds, r.SessionId)
+			recycle := Config.Recycle(r.InstanceType).ShouldRecycle(r.SessionCount+1, r.CreatedAt, now)
+
+			switch {
+			case r.Status != INSTANCE_STATUS_DRAINING && r.Active > 0 && !recycle:
+				// no new sessions, terminated by CompleteDrainingInstances once the other slots are done
+				_, err = db.Exec(ctx, `UPDATE pixel_streaming_instance SET status = $1, drained_at = now(), session_count = session_count + 1, updated_at = now() WHERE id = $2`, INSTANCE_STATUS_DRAINING, r.Id)
+			case r.Status != INSTANCE_STATUS_DRAINING && r.Active == 0 && recycle:
+				_, err = db.Exec(ctx, `UPDATE pixel_streaming_instance SET status = $1, session_count = session_count + 1, updated_at = now() WHERE id = $2`, INSTANCE_STATUS_CLEANING, r.Id)
+			default:
+				// status is changed to deleted once terminated, draining instances keep their status until the drain completes
+				_, err = db.Exec(ctx, `UPDATE pixel_streaming_instance SET session_count = session_count + 1, updated_at = now() WHERE id = $1`, r.Id)
+				if r.Status != INSTANCE_STATUS_DRAINING && r.Active == 0 && r.InstanceId != nil && !slices.Contains(terminateInstanceIds, *r.InstanceId) {
+					terminateInstanceIds = append(terminateInstanceIds, *r.InstanceId)
+				}
+			}
+
+			if err != nil {
+				logrus.Errorf("failed to update %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+				return fmt.Errorf("failed to update %s", PSInstanceSingular)
+			}
+		}
+
+		if len(sessionIds) > 0 {
+			_, err = db.Exec(ctx, `UPDATE pixel_streaming_sessions SET released_at = now() WHERE id = ANY($1)`, sessionIds)
+			if err != nil {
+				logrus.Errorf("failed to update %s @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+				return fmt.Errorf("failed to update %s", PSSessionPlural)
+			}
+		}
+
+		var failedInstanceIds []string
+		failedInstanceIds, err = GetFailedCleanupInstanceIds(ctx, regionId, now)
+		if err != nil {
+			return err
+		}
+		terminateInstanceIds = append(terminateInstanceIds, failedInstanceIds...)
+
+		if len(terminateInstanceIds) == 0 {
+			continue
+		}
+
+		ec2Client, err := NewEC2Client(ctx, regionName)
+		if err != nil {
+			return err
+		}
+
+		err = ExecuteInstanceAction(ctx, ec2Client, "reconcile", INSTANCE_ACTION_TERMINATE, terminateInstanceIds)
+		if err != nil {
+			return fmt.Errorf("failed to terminate: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		}
+	}
+
+	return nil
+}
+
+// GetFailedCleanupInstanceIds returns the instances which reported a failed cleanup or exceeded the cleanup timeout of their instance type.
+func GetFailedCleanupInstanceIds(ctx context.Context, regionId uuid.UUID, now time.Time) (instanceIds []string, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT instance_id, instance_type, status, updated_at FROM pixel_streaming_instance WHERE region_id = $1 AND status = ANY($2) AND instance_id IS NOT NULL`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, regionId, []string{INSTANCE_STATUS_CLEANING, INSTANCE_STATUS_CLEANUP_FAILED})
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get %s", PSInstancePlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			instanceId   string
+			instanceType string
+			status       string
+			updatedAt    *time.Time
+		)
+
+		err = rows.Scan(&instanceId, &instanceType, &status, &updatedAt)
+		if err != nil {
+			logrus.Errorf("failed to scan %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get %s", PSInstancePlural)
+		}
+
+		if status == INSTANCE_STATUS_CLEANING {
+			timeout := Config.Recycle(instanceType).CleanupTimeout.Duration
+			if timeout <= 0 || updatedAt == nil || now.Sub(*updatedAt) <= timeout {
+				continue
+			}
+
+			logrus.Warnf("%s %s has not finished cleanup in %s", PSInstanceSingular, instanceId, timeout)
+		}
+
+		instanceIds = append(instanceIds, instanceId)
+	}
+
+	return instanceIds, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+var (
+	ErrNoRegion = errors.New("no region available")
+
+	geoIP     *geoip2.Reader
+	geoIPOnce sync.Once
+)
+
+// RegionHints are the client hints used to pick the region of a new session, all of them are optional.
+type RegionHints struct {
+	ClientIp string             `json:"clientIp,omitempty"` // looked up in the GeoIP database
+	Rtts     map[string]float64 `json:"rtts,omitempty"`     // milliseconds measured by the client to the region ping endpoints, keyed by region id
+}
+
+// ClientLocation is the location of the client resolved from the GeoIP database.
+type ClientLocation struct {
+	Continent string
+	Latitude  *float64
+	Longitude *float64
+}
+
+// GetRegionsMetadata returns the regions with their coordinates, continent and ping endpoint.
+func GetRegionsMetadata(ctx context.Context) (regions []Region, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return regions, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT id, name, latitude, longitude, continent, ping_url FROM region ORDER BY name`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", RegionPlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get %s", RegionPlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var region Region
+		err = rows.Scan(&region.Id, &region.Name, &region.Latitude, &region.Longitude, &region.Continent, &region.PingUrl)
+		if err != nil {
+			logrus.Errorf("failed to scan %s @ %s: %v", RegionPlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get %s", RegionPlural)
+		}
+
+		regions = append(regions, region)
+	}
+
+	return regions, nil
+}
+
+// GetRegionFreeSlots returns the free slots of the release pool in each region left after the sessions already waiting for them.
+func GetRegionFreeSlots(ctx context.Context, releaseId *uuid.UUID) (freeSlots map[uuid.UUID]int32, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT r.id,
+	COALESCE((SELECT SUM(GREATEST(psi.slots - (SELECT COUNT(*) FROM pixel_streaming_sessions pss WHERE pss.instance_id = psi.id AND pss.status = ANY($2)), 0))
+		FROM pixel_streaming_instance psi WHERE psi.region_id = r.id AND psi.status = ANY($1) AND psi.release_id IS NOT DISTINCT FROM $4), 0)
+	- (SELECT COUNT(*) FROM pixel_streaming_sessions pss WHERE pss.region_id = r.id AND pss.status = $3 AND pss.instance_id IS NULL AND pss.release_id IS NOT DISTINCT FROM $4)
+FROM region r`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, []string{INSTANCE_STATUS_FREE, INSTANCE_STATUS_OCCUPIED}, ActiveSessionStatuses, SESSION_STATUS_PENDING, releaseId)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", RegionPlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get %s", RegionPlural)
+	}
+	defer rows.Close()
+
+	freeSlots = make(map[uuid.UUID]int32)
+	for rows.Next() {
+		var (
+			regionId uuid.UUID
+			free     int32
+		)
+
+		err = rows.Scan(&regionId, &free)
+		if err != nil {
+			logrus.Errorf("failed to scan %s @ %s: %v", RegionPlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get %s", RegionPlural)
+		}
+
+		freeSlots[regionId] = free
+	}
+
+	return freeSlots, nil
+}
+
+// LookupClientLocation resolves the client address with the GeoIP database configured by geoipDatabase, both country and city databases are supported.
+func LookupClientLocation(clientIp string) (*ClientLocation, error) {
+	geoIPOnce.Do(func() {
+		if Config.GeoIPDatabase == "" {
+			return
+		}
+
+		var err error
+		geoIP, err = geoip2.Open(Config.GeoIPDatabase)
+		if err != nil {
+			logrus.Errorf("failed to open geoip database %s: %v", Config.GeoIPDatabase, err)
+		}
+	})
+
+	if geoIP == nil || clientIp == "" {
+		return nil, nil
+	}
+
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client ip %s", clientIp)
+	}
+
+	if strings.Contains(geoIP.Metadata().DatabaseType, "City") {
+		city, err := geoIP.City(ip)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up %s: %v", clientIp, err)
+		}
+
+		location := &ClientLocation{Continent: city.Continent.Code}
+		if city.Location.Latitude != 0 || city.Location.Longitude != 0 {
+			location.Latitude = &city.Location.Latitude
+			location.Longitude = &city.Location.Longitude
+		}
+
+		return location, nil
+	}
+
+	country, err := geoIP.Country(ip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %v", clientIp, err)
+	}
+
+	return &ClientLocation{Continent: country.Continent.Code}, nil
+}
+
+// RankRegions orders the regions from the closest to the client, measured RTTs win over the distance to the client location,
+// regions on the client continent come first when the distance is unknown.
+func RankRegions(regions []Region, location *ClientLocation, rtts map[uuid.UUID]float64) []Region {
+	ranks := make(map[uuid.UUID]regionRank, len(regions))
+	for _, region := range regions {
+		ranks[*region.Id] = rankRegion(region, location, rtts)
+	}
+
+	ranked := make([]Region, len(regions))
+	copy(ranked, regions)
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranks[*ranked[i].Id], ranks[*ranked[j].Id]
+		if a.tier != b.tier {
+			return a.tier < b.tier
+		}
+
+		return a.value < b.value
+	})
+
+	return ranked
+}
+
+// regionRank is the sort key of a region, regions are ordered by tier and then by value within the tier.
+type regionRank struct {
+	tier  int     // 0 measured RTT, 1 distance to the client location, 2 client continent, 3 unknown
+	value float64 // RTT in milliseconds or distance in kilometers
+}
+
+// rankRegion returns the sort key of the region from the best measure of its distance to the client.
+func rankRegion(region Region, location *ClientLocation, rtts map[uuid.UUID]float64) regionRank {
+	if rtt, ok := rtts[*region.Id]; ok {
+		return regionRank{tier: 0, value: rtt}
+	}
+
+	if location == nil {
+		return regionRank{tier: 3}
+	}
+
+	if location.Latitude != nil && location.Longitude != nil {
+		if distance, ok := regionDistance(region, *location.Latitude, *location.Longitude); ok {
+			return regionRank{tier: 1, value: distance}
+		}
+	}
+
+	if region.Continent != nil && *region.Continent == location.Continent {
+		return regionRank{tier: 2}
+	}
+
+	return regionRank{tier: 3}
+}
+
+// SelectRegion picks the closest region with a free slot of the release pool, the closest region is picked if none has a free slot so the session waits for the scale up there.
+func SelectRegion(ctx context.Context, releaseId *uuid.UUID, hints RegionHints) (regionId uuid.UUID, err error) {
+	var regions []Region
+	regions, err = GetRegionsMetadata(ctx)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if len(regions) == 0 {
+		return uuid.Nil, ErrNoRegion
+	}
+
+	rtts := make(map[uuid.UUID]float64)
+	for id, rtt := range hints.Rtts {
+		if rttRegionId, err := uuid.FromString(id); err == nil {
+			rtts[rttRegionId] = rtt
+		}
+	}
+
+	location, err := LookupClientLocation(hints.ClientIp)
+	if err != nil {
+		// the session is still placed, only without the location
+		logrus.Warnf("failed to locate the client: %v", err)
+	}
+
+	var freeSlots map[uuid.UUID]int32
+	freeSlots, err = GetRegionFreeSlots(ctx, releaseId)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	ranked := RankRegions(regions, location, rtts)
+	for _, region := range ranked {
+		if freeSlots[*region.Id] > 0 {
+			return *region.Id, nil
+		}
+	}
+
+	return *ranked[0].Id, nil
+}
+
+// regionDistance returns the great-circle distance in kilometers from the region to the point.
+func regionDistance(region Region, latitude float64, longitude float64) (float64, bool) {
+	if region.Latitude == nil || region.Longitude == nil {
+		return 0, false
+	}
+
+	const earthRadius = 6371.0
+
+	lat1, lat2 := *region.Latitude*math.Pi/180, latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (longitude - *region.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h)), true
+}
+
+func handleRegions(w http.ResponseWriter, r *http.Request) {
+	regions, err := GetRegionsMetadata(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusOK, regions)
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"math/rand"
+	"net/http"
+	"time"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+const (
+	ROLLOUT_STATUS_WARMING     = "warming"
+	ROLLOUT_STATUS_ACTIVE      = "active"
+	ROLLOUT_STATUS_ROLLED_BACK = "rolled-back"
+)
+
+var (
+	RolloutSingular = "Rollout"
+	RolloutPlural   = "Rollouts"
+
+	ErrRolloutNotFound = errors.New("rollout not found")
+	ErrRollbackDenied  = errors.New("rollout has no previous release")
+)
+
+// Rollout is the release cutover of an app, new sessions use ReleaseId for Percentage of them and PreviousReleaseId for the rest.
+type Rollout struct {
+	AppId             *uuid.UUID `json:"appId,omitempty"`
+	ReleaseId         *uuid.UUID `json:"releaseId,omitempty"`
+	PreviousReleaseId *uuid.UUID `json:"previousReleaseId,omitempty"`
+	Percentage        int32      `json:"percentage"`
+	Status            string     `json:"status"`
+	StartedAt         *time.Time `json:"startedAt,omitempty"`
+
+	Timestamps
+}
+
+// PickRelease returns the release of a new session of the app.
+func (r Rollout) PickRelease() *uuid.UUID {
+	if r.PreviousReleaseId == nil {
+		return r.ReleaseId
+	}
+
+	if r.Status == ROLLOUT_STATUS_WARMING || rand.Int31n(100) >= r.Percentage {
+		return r.PreviousReleaseId
+	}
+
+	return r.ReleaseId
+}
+
+// RetiredReleaseId returns the previous release once it no longer receives new sessions.
+func (r Rollout) RetiredReleaseId() *uuid.UUID {
+	if r.Status == ROLLOUT_STATUS_WARMING || r.Percentage < 100 {
+		return nil
+	}
+
+	return r.PreviousReleaseId
+}
+
+// Weight returns the percentage of new sessions the release receives, the new release pool gets the full weight while it is warming up.
+func (r Rollout) Weight(releaseId uuid.UUID) int32 {
+	isNew := r.ReleaseId != nil && *r.ReleaseId == releaseId
+	switch {
+	case r.PreviousReleaseId == nil || r.Status == ROLLOUT_STATUS_WARMING:
+		return 100
+	case isNew:
+		return r.Percentage
+	default:
+		return 100 - r.Percentage
+	}
+}
+
+// PoolReleaseIds returns the releases of the app which keep their instance pools.
+func (r Rollout) PoolReleaseIds() (releaseIds []uuid.UUID) {
+	if r.ReleaseId != nil {
+		releaseIds = append(releaseIds, *r.ReleaseId)
+	}
+
+	if r.PreviousReleaseId != nil && r.RetiredReleaseId() == nil {
+		releaseIds = append(releaseIds, *r.PreviousReleaseId)
+	}
+
+	return releaseIds
+}
+
+// GetRollouts returns the rollouts keyed by app id.
+func GetRollouts(ctx context.Context) (rollouts map[uuid.UUID]Rollout, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT app_id, release_id, previous_release_id, percentage, status, started_at, created_at, updated_at FROM pixel_streaming_rollout`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", RolloutPlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get %s", RolloutPlural)
+	}
+	defer rows.Close()
+
+	rollouts = make(map[uuid.UUID]Rollout)
+	for rows.Next() {
+		var rollout Rollout
+		err = rows.Scan(
+			&rollout.AppId,
+			&rollout.ReleaseId,
+			&rollout.PreviousReleaseId,
+			&rollout.Percentage,
+			&rollout.Status,
+			&rollout.StartedAt,
+			&rollout.CreatedAt,
+			&rollout.UpdatedAt,
+		)
+
+		if err != nil {
+			logrus.Errorf("failed to scan %s @ %s: %v", RolloutPlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get %s", RolloutPlural)
+		}
+
+		rollouts[*rollout.AppId] = rollout
+	}
+
+	return rollouts, nil
+}
+
+// ReconcileRollouts starts a rollout when a newer release pool of an app is configured, cuts new sessions over once the new pool is warm
+// and retires the previous release: its instances are drained and terminated as their sessions end.
+func ReconcileRollouts(ctx context.Context) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	var rollouts map[uuid.UUID]Rollout
+	rollouts, err = GetRollouts(ctx)
+	if err != nil {
+		return err
+	}
+
+	var latest map[uuid.UUID]uuid.UUID
+	latest, err = getLatestPoolReleases(ctx)
+	if err != nil {
+		return err
+	}
+
+	for appId, releaseId := range latest {
+		if Config.App(&appId).RolloutDisabled() {
+			// picked by the configuration
+			continue
+		}
+
+		rollout, ok := rollouts[appId]
+		switch {
+		case !ok:
+			q := `INSERT INTO pixel_streaming_rollout (app_id, release_id, percentage, status, started_at, created_at, updated_at) VALUES ($1, $2, 100, $3, now(), now(), now())`
+			_, err = db.Exec(ctx, q, appId, releaseId, ROLLOUT_STATUS_ACTIVE)
+		case *rollout.ReleaseId == releaseId:
+			continue
+		case rollout.Status == ROLLOUT_STATUS_ROLLED_BACK && rollout.PreviousReleaseId != nil && *rollout.PreviousReleaseId == releaseId:
+			// the latest release has been rolled back
+			continue
+		default:
+			logrus.Infof("app %s: rolling out release %s over %s", appId, releaseId, rollout.ReleaseId)
+			q := `UPDATE pixel_streaming_rollout SET previous_release_id = release_id, release_id = $1, percentage = 0, status = $2, started_at = now(), updated_at = now() WHERE app_id = $3`
+			_, err = db.Exec(ctx, q, releaseId, ROLLOUT_STATUS_WARMING, appId)
+		}
+
+		if err != nil {
+			logrus.Errorf("failed to update %s @ %s: %v", RolloutSingular, reflect.FunctionName(), err)
+			return fmt.Errorf("failed to update %s", RolloutSingular)
+		}
+	}
+
+	rollouts, err = GetRollouts(ctx)
+	if err != nil {
+		return err
+	}
+
+	for appId, rollout := range rollouts {
+		if rollout.Status == ROLLOUT_STATUS_WARMING {
+			var warm bool
+			warm, err = isReleaseWarm(ctx, *rollout.ReleaseId)
+			if err != nil {
+				return err
+			}
+
+			timedOut := rollout.StartedAt != nil && time.Since(*rollout.StartedAt) > Config.RolloutWarmupTimeout.Duration
+			if !warm && !timedOut {
+				continue
+			}
+
+			if !warm {
+				logrus.Warnf("app %s: release %s has not warmed up in %s, cutting over", appId, rollout.ReleaseId, Config.RolloutWarmupTimeout)
+			}
+
+			rollout.Status = ROLLOUT_STATUS_ACTIVE
+			rollout.Percentage = Config.RolloutPercentage
+			_, err = db.Exec(ctx, `UPDATE pixel_streaming_rollout SET status = $1, percentage = $2, updated_at = now() WHERE app_id = $3`, rollout.Status, rollout.Percentage, appId)
+			if err != nil {
+				logrus.Errorf("failed to update %s @ %s: %v", RolloutSingular, reflect.FunctionName(), err)
+				return fmt.Errorf("failed to update %s", RolloutSingular)
+			}
+
+			logrus.Infof("app %s: %d%% of new sessions use release %s", appId, rollout.Percentage, rollout.ReleaseId)
+		}
+
+	}
+
+	// pools of the app left out of its rollout are retired, this also covers pools configured before the app had a rollout
+	var pools []InstancePool
+	pools, err = getReleasePools(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, pool := range pools {
+		rollout, ok := rollouts[*pool.AppId]
+		if !ok || Config.App(pool.AppId).RolloutDisabled() || slices.Contains(rollout.PoolReleaseIds(), *pool.ReleaseId) {
+			continue
+		}
+
+		err = RetireRelease(ctx, *pool.ReleaseId, *rollout.ReleaseId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RetireRelease moves the sessions still waiting for the release to its successor and drains or terminates its instances.
+func RetireRelease(ctx context.Context, releaseId uuid.UUID, successorId uuid.UUID) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_sessions SET release_id = $1, updated_at = now() WHERE release_id = $2 AND status = $3 AND instance_id IS NULL`
+	_, err = db.Exec(ctx, q, successorId, releaseId, SESSION_STATUS_PENDING)
+	if err != nil {
+		logrus.Errorf("failed to update %s @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update %s", PSSessionPlural)
+	}
+
+	// instances which have not been launched yet are dropped
+	q = `UPDATE pixel_streaming_instance SET status = $1, updated_at = now() WHERE release_id = $2 AND status = $3 AND instance_id IS NULL`
+	_, err = db.Exec(ctx, q, INSTANCE_STATUS_DELETED, releaseId, INSTANCE_STATUS_PENDING)
+	if err != nil {
+		logrus.Errorf("failed to update %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update %s", PSInstancePlural)
+	}
+
+	var regions map[uuid.UUID]string
+	regions, err = GetRegions(ctx)
+	if err != nil {
+		return err
+	}
+
+	for regionId, regionName := range regions {
+		var instances []PixelStreamingInstance
+		instances, err = ListPixelStreamingInstances(ctx, PixelStreamingInstanceFilter{RegionId: &regionId, ReleaseId: &releaseId, Limit: ADMIN_LIST_MAX_LIMIT})
+		if err != nil {
+			return err
+		}
+
+		var drainInstanceIds, terminateInstanceIds []string
+		for _, instance := range instances {
+			if instance.InstanceId == nil || instance.Status == nil {
+				continue
+			}
+
+			switch *instance.Status {
+			case INSTANCE_STATUS_FREE, INSTANCE_STATUS_OCCUPIED, INSTANCE_STATUS_PENDING:
+				drainInstanceIds = append(drainInstanceIds, *instance.InstanceId)
+			case INSTANCE_STATUS_STOPPED:
+				terminateInstanceIds = append(terminateInstanceIds, *instance.InstanceId)
+			}
+		}
+
+		if len(drainInstanceIds) == 0 && len(terminateInstanceIds) == 0 {
+			continue
+		}
+
+		logrus.Infof("retiring release %s in %s", releaseId, regionName)
+
+		ec2Client, err := NewEC2Client(ctx, regionName)
+		if err != nil {
+			return err
+		}
+
+		err = ExecuteInstanceAction(ctx, ec2Client, "rollout", INSTANCE_ACTION_DRAIN, drainInstanceIds)
+		if err != nil {
+			return fmt.Errorf("failed to drain: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		}
+
+		err = ExecuteInstanceAction(ctx, ec2Client, "rollout", INSTANCE_ACTION_TERMINATE, terminateInstanceIds)
+		if err != nil {
+			return fmt.Errorf("failed to terminate: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		}
+	}
+
+	return nil
+}
+
+// RollbackRollout sends all new sessions of the app back to the previous release, the rolled back release is retired.
+func RollbackRollout(ctx context.Context, appId uuid.UUID) (rollout Rollout, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return rollout, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_rollout SET release_id = previous_release_id, previous_release_id = release_id, percentage = 100, status = $1, updated_at = now()
+WHERE app_id = $2 AND previous_release_id IS NOT NULL AND status <> $1`
+
+	tag, err := db.Exec(ctx, q, ROLLOUT_STATUS_ROLLED_BACK, appId)
+	if err != nil {
+		logrus.Errorf("failed to update %s @ %s: %v", RolloutSingular, reflect.FunctionName(), err)
+		return rollout, fmt.Errorf("failed to update %s", RolloutSingular)
+	}
+
+	rollouts, err := GetRollouts(ctx)
+	if err != nil {
+		return rollout, err
+	}
+
+	rollout, ok = rollouts[appId]
+	if !ok {
+		return rollout, ErrRolloutNotFound
+	}
+
+	if tag.RowsAffected() == 0 {
+		return rollout, ErrRollbackDenied
+	}
+
+	logrus.Infof("app %s: rolled back to release %s", appId, rollout.ReleaseId)
+
+	return rollout, nil
+}
+
+// SetRolloutPercentage changes the share of new sessions using the new release of an active rollout.
+func SetRolloutPercentage(ctx context.Context, appId uuid.UUID, percentage int32) (rollout Rollout, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return rollout, fmt.Errorf("unable to get database connection")
+	}
+
+	_, err = db.Exec(ctx, `UPDATE pixel_streaming_rollout SET percentage = $1, updated_at = now() WHERE app_id = $2 AND status = $3`, percentage, appId, ROLLOUT_STATUS_ACTIVE)
+	if err != nil {
+		logrus.Errorf("failed to update %s @ %s: %v", RolloutSingular, reflect.FunctionName(), err)
+		return rollout, fmt.Errorf("failed to update %s", RolloutSingular)
+	}
+
+	rollouts, err := GetRollouts(ctx)
+	if err != nil {
+		return rollout, err
+	}
+
+	rollout, ok = rollouts[appId]
+	if !ok {
+		return rollout, ErrRolloutNotFound
+	}
+
+	return rollout, nil
+}
+
+// getLatestPoolReleases returns the most recently created release with a configured pool of each app.
+func getLatestPoolReleases(ctx context.Context) (latest map[uuid.UUID]uuid.UUID, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	var releaseIds []uuid.UUID
+	for id := range Config.Releases {
+		if releaseId, err := uuid.FromString(id); err == nil {
+			releaseIds = append(releaseIds, releaseId)
+		}
+	}
+
+	latest = make(map[uuid.UUID]uuid.UUID)
+	if len(releaseIds) == 0 {
+		return latest, nil
+	}
+
+	q := `SELECT DISTINCT ON (app_id) app_id, id FROM releases WHERE id = ANY($1) AND app_id IS NOT NULL AND archive IS NOT TRUE ORDER BY app_id, created_at DESC`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, releaseIds)
+	if err != nil {
+		logrus.Errorf("failed to query releases @ %s: %v", reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get releases")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var appId, releaseId uuid.UUID
+		err = rows.Scan(&appId, &releaseId)
+		if err != nil {
+			logrus.Errorf("failed to scan releases @ %s: %v", reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get releases")
+		}
+
+		latest[appId] = releaseId
+	}
+
+	return latest, nil
+}
+
+// isReleaseWarm reports whether the release has a free instance in every region.
+func isReleaseWarm(ctx context.Context, releaseId uuid.UUID) (warm bool, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return false, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT COUNT(*) FROM region r
+WHERE NOT EXISTS (SELECT 1 FROM pixel_streaming_instance psi WHERE psi.region_id = r.id AND psi.release_id = $1 AND psi.status = $2)`
+
+	var cold int32
+	err = db.QueryRow(ctx, q, releaseId, INSTANCE_STATUS_FREE).Scan(&cold)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return false, fmt.Errorf("failed to get %s", PSInstancePlural)
+	}
+
+	return cold == 0, nil
+}
+
+// RolloutPercentageRequest sets the share of new sessions using the new release.
+type RolloutPercentageRequest struct {
+	Percentage *int32 `json:"percentage"`
+}
+
+// handleAdminRollouts serves GET /admin/rollouts, POST /admin/rollouts/{appId}/rollback and POST /admin/rollouts/{appId}/percentage.
+func handleAdminRollouts(w http.ResponseWriter, r *http.Request) {
+	parts := adminPathParts(r.URL.Path, "/admin/rollouts")
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		listAdminRollouts(w, r)
+	case len(parts) == 2 && (parts[1] == "rollback" || parts[1] == "percentage") && r.Method == http.MethodPost:
+		updateAdminRollout(w, r, parts[0], parts[1])
+	case len(parts) == 0 || len(parts) == 2 && (parts[1] == "rollback" || parts[1] == "percentage"):
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func listAdminRollouts(w http.ResponseWriter, r *http.Request) {
+	rollouts, err := GetRollouts(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	list := make([]Rollout, 0, len(rollouts))
+	for _, rollout := range rollouts {
+		list = append(list, rollout)
+	}
+
+	writeJson(w, http.StatusOK, list)
+}
+
+func updateAdminRollout(w http.ResponseWriter, r *http.Request, rawAppId string, action string) {
+	appId, err := uuid.FromString(rawAppId)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid app id")
+		return
+	}
+
+	var rollout Rollout
+	if action == "rollback" {
+		rollout, err = RollbackRollout(r.Context(), appId)
+	} else {
+		var request RolloutPercentageRequest
+		if !readJson(w, r, &request) {
+			return
+		}
+
+		if request.Percentage == nil || *request.Percentage < 0 || *request.Percentage > 100 {
+			writeError(w, http.StatusBadRequest, "percentage should be between 0 and 100")
+			return
+		}
+
+		rollout, err = SetRolloutPercentage(r.Context(), appId, *request.Percentage)
+	}
+
+	if errors.Is(err, ErrRolloutNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if errors.Is(err, ErrRollbackDenied) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusOK, rollout)
+}
+
+// RunRollbackCommand rolls the app given as the only argument back to its previous release.
+func RunRollbackCommand(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: rollback <app id>")
+	}
+
+	appId, err := uuid.FromString(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid app id %s", args[0])
+	}
+
+	rollout, err := RollbackRollout(ctx, appId)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("app %s: new sessions use release %s, release %s is retired\n", appId, rollout.ReleaseId, rollout.PreviousReleaseId)
+
+	return nil
+}
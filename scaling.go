@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"math"
+	"time"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+const (
+	// SCALING_MODE_FIXED keeps the configured freeSlots
+	SCALING_MODE_FIXED = "fixed"
+	// SCALING_MODE_TARGET_TRACKING keeps the free slots the sessions arriving while a fresh instance boots need
+	SCALING_MODE_TARGET_TRACKING = "target-tracking"
+
+	// BILLING_PERIOD_MARGIN is the time before the end of a billing period in which an instance may be removed, the planner has to check
+	// the pool at least once within it
+	BILLING_PERIOD_MARGIN = 5 * time.Minute
+)
+
+// ScalingConfig returns the scaling of the pool, the scaling of the operator if its release has none.
+func (p InstancePool) ScalingConfig() ScalingConfig {
+	if p.Scaling != nil {
+		return *p.Scaling
+	}
+
+	return Config.Scaling
+}
+
+// ValidateScaling checks the scaling of the operator and of the release pools.
+func ValidateScaling() error {
+	if err := Config.Scaling.validate(); err != nil {
+		return fmt.Errorf("scaling: %v", err)
+	}
+
+	for id, releasePool := range Config.Releases {
+		if releasePool.Scaling == nil {
+			continue
+		}
+
+		if err := releasePool.Scaling.validate(); err != nil {
+			return fmt.Errorf("scaling of release %s: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+func (s ScalingConfig) validate() error {
+	if s.BillingPeriod.Duration > 0 && s.BillingPeriod.Duration <= BILLING_PERIOD_MARGIN {
+		return fmt.Errorf("billing period must be longer than %s", BILLING_PERIOD_MARGIN)
+	}
+
+	switch s.Mode {
+	case "", SCALING_MODE_FIXED:
+		return nil
+	case SCALING_MODE_TARGET_TRACKING:
+	default:
+		return fmt.Errorf("unknown mode %s", s.Mode)
+	}
+
+	if s.Window.Duration < time.Minute {
+		return fmt.Errorf("window must be at least a minute")
+	}
+
+	for instanceType, maxFreeSlots := range s.MaxFreeSlots {
+		if maxFreeSlots < s.MinFreeSlots[instanceType] {
+			return fmt.Errorf("max %s free slots are less than the min", instanceType)
+		}
+	}
+
+	return nil
+}
+
+// removable reports whether an instance launched or started at the time may be removed now: it has run for the minimum lifetime and, if
+// instances are billed by period, its current period ends within BILLING_PERIOD_MARGIN.
+func (s ScalingConfig) removable(startedAt time.Time, now time.Time) bool {
+	age := now.Sub(startedAt)
+	if age < s.MinLifetime.Duration {
+		return false
+	}
+
+	if period := s.BillingPeriod.Duration; period > 0 {
+		return period-age%period <= BILLING_PERIOD_MARGIN
+	}
+
+	return true
+}
+
+// GetSessionArrivalRate returns the sessions per second started for the key (app id or default) in the region within the window before the time.
+func GetSessionArrivalRate(ctx context.Context, regionId uuid.UUID, key string, now time.Time, window time.Duration) (rate float64, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return 0, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT COUNT(*) FROM pixel_streaming_sessions s
+WHERE s.region_id = $1 AND s.created_at >= $2 AND s.created_at < $3
+	AND ($4 = $5 AND s.release_id IS NULL OR s.app_id::text = $4 AND s.release_id IS NOT NULL)`
+
+	var count int64
+	err = db.QueryRow(ctx, q, regionId, now.Add(-window), now, key, FORECAST_DEFAULT_KEY).Scan(&count)
+	if err != nil {
+		logrus.Errorf("failed to query %s arrivals @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+		return 0, fmt.Errorf("failed to get %s arrivals", PSSessionPlural)
+	}
+
+	return float64(count) / window.Seconds(), nil
+}
+
+// TrackDemand sets the free slots of each instance type of a target-tracking pool to the sessions arriving while a fresh instance of the
+// type boots: the arrival rate of the sessions of its app in the region, scaled by the weight of the pool and split between the instance
+// types like the configured free slots, multiplied by the boot time and bounded by the min and max free slots. Active capacity profiles
+// keep their free slots.
+func TrackDemand(ctx context.Context, regionId uuid.UUID, pool InstancePool, target *CapacityTarget, now time.Time) (err error) {
+	scaling := pool.ScalingConfig()
+	if scaling.Mode != SCALING_MODE_TARGET_TRACKING || target.Profile != "" || pool.Weight <= 0 {
+		return nil
+	}
+
+	var rate float64
+	rate, err = GetSessionArrivalRate(ctx, regionId, forecastKey(pool), now, scaling.Window.Duration)
+	if err != nil {
+		return err
+	}
+
+	base := make(map[string]int32)
+	for instanceType := range target.FreeSlots {
+		base[instanceType] = pool.FreeSlots(instanceType)
+	}
+
+	target.Demand = make(map[string]float64)
+	for instanceType, share := range freeSlotShares(base) {
+		var latency time.Duration
+		latency, err = GetBootLatency(ctx, regionId, instanceType)
+		if err != nil {
+			return err
+		}
+
+		demand := rate * latency.Seconds() * float64(pool.Weight) / 100 * share
+		target.Demand[instanceType] = math.Round(demand*100) / 100
+
+		freeSlots := int32(math.Ceil(demand))
+		if minFreeSlots := pool.scale(scaling.MinFreeSlots[instanceType]); freeSlots < minFreeSlots {
+			freeSlots = minFreeSlots
+		}
+		if maxFreeSlots, ok := scaling.MaxFreeSlots[instanceType]; ok && freeSlots > pool.scale(maxFreeSlots) {
+			freeSlots = pool.scale(maxFreeSlots)
+		}
+
+		target.FreeSlots[instanceType] = freeSlots
+	}
+
+	return nil
+}
+
+// GetScaleDownInstanceIds returns the free instances of the pool in the region the excess free slots allow to remove, most crowded subnets
+// first: none within the hysteresis of the pool or its scale down cooldown, otherwise up to an instance per excess slots beyond the hysteresis
+// of those which may be removed now.
+func GetScaleDownInstanceIds(ctx context.Context, regionId uuid.UUID, pool InstancePool, instanceType string, excessSlots int32, slots int, now time.Time) (instanceIds []string, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	scaling := pool.ScalingConfig()
+
+	count := int((excessSlots - pool.scale(scaling.ScaleDownHysteresis)) / int32(slots))
+	if count <= 0 {
+		return nil, nil
+	}
+
+	if scaling.ScaleDownCooldown.Duration > 0 {
+		// launches, starts and removals are scaling, the last one is the latest of their times
+		q := `SELECT GREATEST(MAX(created_at), MAX(boot_started_at), MAX(scaled_down_at)) FROM pixel_streaming_instance
+WHERE region_id = $1 AND instance_type = $2 AND release_id IS NOT DISTINCT FROM $3 AND COALESCE(platform, 'windows') = $4`
+
+		var scaledAt *time.Time
+		err = db.QueryRow(ctx, q, regionId, instanceType, pool.ReleaseId, pool.Platform).Scan(&scaledAt)
+		if err != nil {
+			logrus.Errorf("failed to query %s scaling @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get %s scaling", PSInstancePlural)
+		}
+
+		if scaledAt != nil && now.Sub(*scaledAt) < scaling.ScaleDownCooldown.Duration {
+			return nil, nil
+		}
+	}
+
+	q := `SELECT instance_id, COALESCE(boot_started_at, created_at) FROM pixel_streaming_instance psi
+WHERE region_id = $1 AND instance_type = $2 AND status = $3 AND instance_id IS NOT NULL AND release_id IS NOT DISTINCT FROM $4 AND COALESCE(platform, 'windows') = $5
+ORDER BY (
+	SELECT COUNT(*) FROM pixel_streaming_instance o
+	WHERE o.region_id = psi.region_id AND o.subnet_id = psi.subnet_id AND o.release_id IS NOT DISTINCT FROM psi.release_id
+		AND COALESCE(o.platform, 'windows') = $5 AND o.status <> $6
+) DESC, created_at`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, regionId, instanceType, INSTANCE_STATUS_FREE, pool.ReleaseId, pool.Platform, INSTANCE_STATUS_DELETED)
+	if err != nil {
+		logrus.Errorf("failed to query free %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get free %s", PSInstancePlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			instanceId string
+			startedAt  time.Time
+		)
+
+		err = rows.Scan(&instanceId, &startedAt)
+		if err != nil {
+			logrus.Errorf("failed to scan free %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get free %s", PSInstancePlural)
+		}
+
+		if len(instanceIds) < count && scaling.removable(startedAt, now) {
+			instanceIds = append(instanceIds, instanceId)
+		}
+	}
+
+	return instanceIds, nil
+}
+
+// markInstancesScaledDown records the removal of excess instances, it starts the scale down cooldown of their pool.
+func markInstancesScaledDown(ctx context.Context, instanceIds []string) (err error) {
+	if len(instanceIds) == 0 {
+		return nil
+	}
+
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_instance SET scaled_down_at = now() WHERE instance_id = ANY($1)`
+	_, err = db.Exec(ctx, q, instanceIds)
+	if err != nil {
+		logrus.Errorf("failed to update scaled down %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update scaled down %s", PSInstancePlural)
+	}
+
+	return nil
+}
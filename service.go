@@ -21,6 +21,7 @@ ve-ps-launcher.exe -> refresh session metadata -> if session is closed -> close
 Tables:
 PS Instance (pixel_streaming_instance)
 PS Session (pixel_streaming_session)
+Schema changes are in migrations (golang-migrate format), apply them before deploying the operator.
 
 Entities:
 Operator - single orchestrating go service that manages instances (start, stop, delete)
@@ -48,7 +49,6 @@ Launcher does not know anything about the machine it is running at, the machine
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -61,6 +61,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/exp/slices"
 	"os"
+	"time"
 	"veverse-pixelstreaming-operator/reflect"
 )
 
@@ -73,13 +74,20 @@ const (
 	PS_STATUS_SHUTTING_DOWN = "shutting-down"
 	PS_STATUS_TERMINATED    = "terminated"
 
+	INSTANCE_STATUS_PENDING        = "pending"
+	INSTANCE_STATUS_FREE           = "free"
+	INSTANCE_STATUS_OCCUPIED       = "occupied"
+	INSTANCE_STATUS_CLEANING       = "cleaning"
+	INSTANCE_STATUS_CLEANUP_FAILED = "cleanup-failed"
+	INSTANCE_STATUS_DRAINING       = "draining"
+	INSTANCE_STATUS_STOPPED        = "stopped"
+	INSTANCE_STATUS_STARTING       = "starting"
+	INSTANCE_STATUS_DELETED        = "deleted"
+
 	FREE_SPOTS_AVAILABLE        int32 = 1
 	FREE_ON_DEMAND_AVAILABLE    int32 = 1
 	STOPPED_ON_DEMAND_AVAILABLE int32 = 1
 
-	AMI_WINDOWS = "ami-xxxxxxxxxxxxxxxxx"
-	AMI_LINUX   = "ami-xxxxxxxxxxxxxxxxx"
-
 	WIN_SPOT_LAUNCH_TEMPLATE_ID      = "lt-xxxxxxxxxxxxxxxxx"
 	WIN_ON_DEMAND_LAUNCH_TEMPLATE_ID = "lt-xxxxxxxxxxxxxxxxx"
 )
@@ -92,43 +100,24 @@ var (
 	RegionPlural   = "Regions"
 )
 
-var userData = ``
-
-var encodedUserData = base64.StdEncoding.EncodeToString([]byte(userData))
-
 var (
 	AwsAccessKey   = os.Getenv("AWS_ACCESS_KEY")
 	AwsSecretKey   = os.Getenv("AWS_SECRET_KEY")
-	AMIID          = "ami-xxxxxxxxxxxxxxxxx"
 	keyPair        = "PixelStreamingOpenSSH"
-	subnetId       = "subnet-xxxxxxxxxxxxxxxxx"
 	securityGroups = []string{
 		"sg-xxxxxxxxxxxxxxxxx",
 	}
 
 	cfg aws.Config
 
-	stopInstanceInput = &ec2.StopInstancesInput{
-		InstanceIds: nil,
-		DryRun:      nil,
-		Force:       nil,
-		Hibernate:   nil,
-	}
-
-	terminateInstanceInput = &ec2.TerminateInstancesInput{
-		InstanceIds: nil,
-		DryRun:      nil,
-	}
-
+	// the image and the instance type are set by the pool launching the instance
 	makeSpotInstanceInput = &ec2.RunInstancesInput{
-		ImageId: aws.String(AMI_WINDOWS),
 		LaunchTemplate: &types.LaunchTemplateSpecification{
 			LaunchTemplateId: aws.String(WIN_SPOT_LAUNCH_TEMPLATE_ID),
 		},
-		InstanceType: types.InstanceTypeG5Xlarge,
-		KeyName:      aws.String(keyPair),
-		MaxCount:     aws.Int32(1),
-		MinCount:     aws.Int32(1),
+		KeyName:  aws.String(keyPair),
+		MaxCount: aws.Int32(1),
+		MinCount: aws.Int32(1),
 		TagSpecifications: []types.TagSpecification{
 			{
 				ResourceType: types.ResourceTypeInstance,
@@ -140,18 +129,15 @@ var (
 				},
 			},
 		},
-		//UserData: aws.String(encodedUserData),
 	}
 
 	makeOnDemandInstanceInput = &ec2.RunInstancesInput{
-		ImageId: aws.String(AMI_WINDOWS),
 		LaunchTemplate: &types.LaunchTemplateSpecification{
 			LaunchTemplateId: aws.String(WIN_ON_DEMAND_LAUNCH_TEMPLATE_ID),
 		},
-		InstanceType: types.InstanceTypeG5Xlarge,
-		KeyName:      aws.String(keyPair),
-		MaxCount:     aws.Int32(1),
-		MinCount:     aws.Int32(1),
+		KeyName:  aws.String(keyPair),
+		MaxCount: aws.Int32(1),
+		MinCount: aws.Int32(1),
 		TagSpecifications: []types.TagSpecification{
 			{
 				ResourceType: types.ResourceTypeInstance,
@@ -166,170 +152,195 @@ var (
 	}
 )
 
+// CheckAvailabilitySpotInstance keeps the free spot slots of every instance pool in every region.
 func CheckAvailabilitySpotInstance(ctx context.Context) (err error) {
+	var regions map[uuid.UUID]string
+	regions, err = GetRegions(ctx)
+	if err != nil {
+		return err
+	}
+
+	var pools []InstancePool
+	pools, err = GetInstancePools(ctx)
+	if err != nil {
+		return err
+	}
+
+	for regionId, regionName := range regions {
+		for _, pool := range pools {
+			err = checkAvailabilitySpotPool(ctx, regionId, regionName, pool)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkAvailabilitySpotPool keeps the free spot slots of the pool in the region.
+func checkAvailabilitySpotPool(ctx context.Context, regionId uuid.UUID, regionName string, pool InstancePool) (err error) {
 	db, ok := ctx.Value("database").(*pgxpool.Pool)
 	if !ok {
 		return fmt.Errorf("unable to get database connection")
 	}
 
-	var regions map[uuid.UUID]string
-	regions, err = GetRegions(ctx)
+	target, err := PlanCapacity(ctx, regionId, regionName, pool, time.Now())
+	if err != nil {
+		return err
+	}
 
-	for regionId, regionName := range regions {
-		var (
-			totalAvailableInstance int32 = 0
-			totalFreeInstance      int32 = 0
-		)
+	var (
+		totalAvailableSlot   int32 = 0
+		totalFreeSlot        int32 = 0
+		totalPendingInstance int32 = 0
+		slots                      = pool.Slots("spot")
+		freeSlots                  = target.FreeSlots["spot"]
+	)
 
-		q := `SELECT COUNT(psi.id) total, count(psi2.id) as total_free FROM pixel_streaming_instance psi
-LEFT JOIN pixel_streaming_instance psi2 ON 
-    psi.id = psi2.id AND
-	psi.status IN('free', 'pending') AND
-	psi2.status = 'free' AND
-    psi2.region_id = psi.region_id AND
-    psi.region_id = $1
-WHERE psi.instance_type = 'spot'`
+	// capacity is counted in slots, occupied instances still have the slots not used by their sessions,
+	// draining and cleaning instances are neither free nor available
+	q := `SELECT
+	COALESCE(SUM(GREATEST(psi.slots - COALESCE(pss.active, 0), 0)) FILTER (WHERE psi.status IN ('free', 'occupied', 'pending')), 0) AS total,
+	COALESCE(SUM(GREATEST(psi.slots - COALESCE(pss.active, 0), 0)) FILTER (WHERE psi.status IN ('free', 'occupied')), 0) AS total_free,
+	COUNT(*) FILTER (WHERE psi.status = 'pending') AS total_pending
+FROM pixel_streaming_instance psi
+	LEFT JOIN (SELECT instance_id, COUNT(*) AS active FROM pixel_streaming_sessions WHERE status = ANY($2) GROUP BY instance_id) pss ON pss.instance_id = psi.id
+WHERE psi.region_id = $1 AND psi.instance_type = 'spot' AND psi.release_id IS NOT DISTINCT FROM $3 AND COALESCE(psi.platform, 'windows') = $4`
 
-		row := db.QueryRow(ctx, q, regionId)
+	row := db.QueryRow(ctx, q, regionId, ActiveSessionStatuses, pool.ReleaseId, pool.Platform)
 
-		err = row.Scan(&totalAvailableInstance, &totalFreeInstance)
-		if err != nil {
-			logrus.Errorf("failed to scan %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
-			return fmt.Errorf("failed to scan ps instances total %s", PSInstanceSingular)
+	err = row.Scan(&totalAvailableSlot, &totalFreeSlot, &totalPendingInstance)
+	if err != nil {
+		logrus.Errorf("failed to scan %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to scan ps instances total %s", PSInstanceSingular)
+	}
+
+	cfg, err = config.LoadDefaultConfig(
+		ctx,
+		config.WithRegion(regionName),
+		config.WithClientLogMode(aws.LogRequestWithBody),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(AwsAccessKey, AwsSecretKey, "")),
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to load aws config: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+	}
+
+	var (
+		getInstanceOutput *ec2.DescribeInstancesOutput
+		ec2Client         = ec2.NewFromConfig(cfg)
+	)
+
+	resolveLaunchImage(ctx, ec2Client, regionName, &pool)
+
+	describeInstanceInput := ec2.DescribeInstancesInput{
+		DryRun: nil,
+		Filters: append(
+			pool.Filters("spot"),
+			NewEC2Filter("instance-state-name", PS_STATUS_RUNNING, PS_STATUS_PENDING),
+		),
+	}
+
+	getInstanceOutput, _ = GetInstances(ctx, ec2Client, &describeInstanceInput)
+
+	var reservedInstances []types.Instance
+	if getInstanceOutput != nil && len(getInstanceOutput.Reservations) > 0 {
+		for _, reservation := range getInstanceOutput.Reservations {
+			reservedInstances = append(reservedInstances, reservation.Instances...)
 		}
+	}
 
-		cfg, err = config.LoadDefaultConfig(
-			ctx,
-			config.WithRegion(regionName),
-			config.WithClientLogMode(aws.LogRequestWithBody),
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(AwsAccessKey, AwsSecretKey, "")),
-		)
+	// only instances without sessions are terminated, as many as the excess free slots beyond the hysteresis make up once the cooldown has passed
+	var scaleDownInstanceIds []string
+	scaleDownInstanceIds, err = GetScaleDownInstanceIds(ctx, regionId, pool, "spot", totalFreeSlot-freeSlots, slots, time.Now())
+	if err != nil {
+		return err
+	}
 
+	var availableSpotInstancesCount = CountAWSInstancesByState(reservedInstances, PS_STATUS_RUNNING, PS_STATUS_PENDING)
+	if len(scaleDownInstanceIds) > 0 {
+		logrus.Infof("scaling down %s: %v", PSInstancePlural, scaleDownInstanceIds)
+		err = ExecuteInstanceAction(ctx, ec2Client, "reconcile", INSTANCE_ACTION_TERMINATE, scaleDownInstanceIds)
 		if err != nil {
-			return fmt.Errorf("failed to load aws config: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return fmt.Errorf("failed to terminate: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
 		}
 
+		err = markInstancesScaledDown(ctx, scaleDownInstanceIds)
+		if err != nil {
+			return err
+		}
+	} else if availableSpotInstancesCount > 0 && availableSpotInstancesCount >= totalPendingInstance {
+		// update
 		var (
-			runInstanceOutput *ec2.RunInstancesOutput
-			getInstanceOutput *ec2.DescribeInstancesOutput
-			ec2Client         = ec2.NewFromConfig(cfg)
+			freeInstanceIds      []string
+			pendingInstanceUUIDs []uuid.UUID
 		)
 
-		describeInstanceInput := ec2.DescribeInstancesInput{
-			DryRun: nil,
-			Filters: []types.Filter{
-				{
-					Name:   aws.String("image-id"),
-					Values: []string{AMI_WINDOWS},
-				},
-				NewEC2Filter("tag:aws:ec2launchtemplate:id", WIN_SPOT_LAUNCH_TEMPLATE_ID),
-				NewEC2Filter("instance-state-name", PS_STATUS_RUNNING, PS_STATUS_PENDING),
-			},
+		freeInstanceIds, pendingInstanceUUIDs, err = GetInstanceIds(ctx, regionId, pool, "spot", "free", "pending")
+		if err != nil {
+			return err
 		}
 
-		getInstanceOutput, _ = GetInstances(ctx, ec2Client, &describeInstanceInput)
-
-		var reservedInstances []types.Instance
-		if getInstanceOutput != nil && len(getInstanceOutput.Reservations) > 0 {
-			reservedInstances = getInstanceOutput.Reservations[0].Instances
-		}
+		for _, instance := range reservedInstances {
+			if instance.InstanceId != nil && instance.PublicIpAddress != nil && instance.State.Name == "running" {
 
-		var availableSpotInstancesCount = CountAWSInstancesByState(reservedInstances, PS_STATUS_RUNNING, PS_STATUS_PENDING)
-		var totalPendingInstance = totalAvailableInstance - totalFreeInstance
-		if totalFreeInstance > FREE_SPOTS_AVAILABLE {
-			// To be terminated
-			var (
-				freeInstanceIds      []string
-				pendingInstanceUUIDs []uuid.UUID
-			)
-
-			fmt.Println("TO BE TERMINATED", freeInstanceIds, pendingInstanceUUIDs)
-			freeInstanceIds, pendingInstanceUUIDs, err = GetInstanceIds(ctx, regionId, "spot", "free", "pending")
-			var terminateCount = totalFreeInstance - FREE_SPOTS_AVAILABLE
-			freeInstanceIds = freeInstanceIds[0:terminateCount]
-			err = TerminateInstances(ctx, ec2Client, freeInstanceIds)
+				if slices.Contains(freeInstanceIds, *instance.InstanceId) {
+					continue
+				}
 
-			if err != nil {
-				return fmt.Errorf("failed to terminate: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
-			} else {
-				data := PixelStreamingInstanceMetadata{
-					Status: aws.String("deleted"),
+				updateID, ok := launchedRowId(instance, &pendingInstanceUUIDs)
+				if !ok {
+					logrus.Warnf("no pending %s for instance %s", PSInstanceSingular, *instance.InstanceId)
+					continue
 				}
 
-				for _, id := range freeInstanceIds {
-					data.InstanceId = &id
-					err = UpdatePixelStreamingInstance(ctx, nil, data)
-					if err != nil {
-						return fmt.Errorf("failed to update running instance data: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
-					}
+				err = markLaunchedInstanceFree(ctx, updateID, *instance.InstanceId, *instance.PublicIpAddress)
+				if err != nil {
+					return fmt.Errorf("failed to update running instance data: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
 				}
 			}
-		} else if availableSpotInstancesCount > 0 && availableSpotInstancesCount >= totalPendingInstance {
-			// update
-			var (
-				freeInstanceIds      []string
-				pendingInstanceUUIDs []uuid.UUID
-			)
-
-			freeInstanceIds, pendingInstanceUUIDs, err = GetInstanceIds(ctx, regionId, "spot", "free", "pending")
-			for _, instance := range reservedInstances {
-				if instance.InstanceId != nil && instance.PublicIpAddress != nil && instance.State.Name == "running" {
-
-					if slices.Contains(freeInstanceIds, *instance.InstanceId) {
-						continue
-					}
-
-					data := PixelStreamingInstanceMetadata{
-						InstanceId: instance.InstanceId,
-						Status:     aws.String("free"),
-						Host:       instance.PublicIpAddress,
-					}
-
-					var updateID uuid.UUID
-					updateID, pendingInstanceUUIDs = pendingInstanceUUIDs[0], pendingInstanceUUIDs[1:]
-					err = UpdatePixelStreamingInstance(ctx, &updateID, data)
-					if err != nil {
-						return fmt.Errorf("failed to update running instance data: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
-					}
+		}
+	} else {
+		if pool.ImageId == "" {
+			logrus.Warnf("no image of release %s is available in %s yet, not launching", pool.ReleaseId, regionName)
+			return nil
+		}
+
+		var makingInstanceCount = int(slotsToInstances(freeSlots-totalAvailableSlot, slots))
+		if makingInstanceCount > 0 {
+			q := `INSERT INTO pixel_streaming_instance (id, region_id, release_id, port, instance_type, status, slots, platform) VALUES (
+				$1, $2, $3, $4, $5, $6, $7, $8
+			)`
+
+			for i := 0; i < makingInstanceCount; i++ {
+				id, err1 := uuid.NewV4()
+				if err1 != nil {
+					logrus.Errorf("failed to generate uuid %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+					return fmt.Errorf("failed to set %s", PSInstanceSingular)
 				}
-			}
-		} else {
-			var makingInstanceCount = int(FREE_SPOTS_AVAILABLE - totalAvailableInstance)
-			if makingInstanceCount > 0 {
-				q := `INSERT INTO pixel_streaming_instance (id, region_id, port, instance_type, status) VALUES (
-					$1, $2, $3, $4, $5                                                 
-				)`
-
-				for i := 0; i < makingInstanceCount; i++ {
-					id, err1 := uuid.NewV4()
-					if err1 != nil {
-						logrus.Errorf("failed to generate uuid %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
-						return fmt.Errorf("failed to set %s", PSInstanceSingular)
-					}
-
-					data := PixelStreamingInstanceMetadata{
-						Id:           &id,
-						RegionId:     &regionId,
-						Port:         aws.Uint16(80),
-						InstanceType: aws.String("spot"),
-						Status:       aws.String("pending"),
-					}
-
-					_, err = db.Exec(ctx, q, data.Id, data.RegionId, data.Port, data.InstanceType, data.Status)
-					if err != nil {
-						logrus.Errorf("failed to insert uuid %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
-						return fmt.Errorf("failed to set %s", PSInstanceSingular)
-					}
+
+				data := PixelStreamingInstanceMetadata{
+					Id:           &id,
+					RegionId:     &regionId,
+					ReleaseId:    pool.ReleaseId,
+					Port:         aws.Uint16(80),
+					InstanceType: aws.String("spot"),
+					Status:       aws.String("pending"),
+					Slots:        aws.Int32(int32(slots)),
+					Platform:     aws.String(pool.Platform),
 				}
-			} else if makingInstanceCount == 0 {
-				makeSpotInstanceInput.MaxCount = aws.Int32(totalAvailableInstance - totalFreeInstance)
 
-				runInstanceOutput, err = MakeInstance(ctx, ec2Client, makeSpotInstanceInput)
+				_, err = db.Exec(ctx, q, data.Id, data.RegionId, data.ReleaseId, data.Port, data.InstanceType, data.Status, data.Slots, data.Platform)
 				if err != nil {
-					return fmt.Errorf("failed to create spot instance: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+					logrus.Errorf("failed to insert uuid %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+					return fmt.Errorf("failed to set %s", PSInstanceSingular)
 				}
-
-				logrus.Infof("Making required free spot instances: %v", runInstanceOutput.Instances)
+			}
+		} else if makingInstanceCount == 0 && totalPendingInstance > 0 {
+			err = LaunchPendingInstances(ctx, ec2Client, regionId, regionName, pool, "spot", makeSpotInstanceInput)
+			if err != nil {
+				return err
 			}
 		}
 	}
@@ -337,213 +348,227 @@ WHERE psi.instance_type = 'spot'`
 	return err
 }
 
+// CheckAvailabilityOnDemandInstance keeps the free and stopped on-demand instances of every instance pool in every region.
 func CheckAvailabilityOnDemandInstance(ctx context.Context) (err error) {
+	var regions map[uuid.UUID]string
+	regions, err = GetRegions(ctx)
+	if err != nil {
+		return err
+	}
+
+	var pools []InstancePool
+	pools, err = GetInstancePools(ctx)
+	if err != nil {
+		return err
+	}
+
+	for regionId, regionName := range regions {
+		for _, pool := range pools {
+			err = checkAvailabilityOnDemandPool(ctx, regionId, regionName, pool)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkAvailabilityOnDemandPool keeps the free on-demand slots and stopped instances of the pool in the region.
+func checkAvailabilityOnDemandPool(ctx context.Context, regionId uuid.UUID, regionName string, pool InstancePool) (err error) {
 	db, ok := ctx.Value("database").(*pgxpool.Pool)
 	if !ok {
 		return fmt.Errorf("unable to get database connection")
 	}
 
-	var regions map[uuid.UUID]string
-	regions, err = GetRegions(ctx)
+	target, err := PlanCapacity(ctx, regionId, regionName, pool, time.Now())
+	if err != nil {
+		return err
+	}
 
-	for regionId, regionName := range regions {
-		var (
-			totalAvailableInstance int32 = 0
-			totalFreeInstance      int32 = 0
-			totalStoppedInstance   int32 = 0
-		)
+	var (
+		totalAvailableSlot   int32 = 0
+		totalFreeSlot        int32 = 0
+		totalStoppedInstance int32 = 0
+		totalPendingInstance int32 = 0
+		totalBootingSlot     int32 = 0
+		slots                      = pool.Slots("on-demand")
+		freeSlots                  = target.FreeSlots["on-demand"]
+		stoppedInstances           = pool.StoppedInstances()
+	)
 
-		q := `SELECT COUNT(psi.id) total, count(psi2.id) as total_free, count(psi3.id) as total_stopped FROM pixel_streaming_instance psi
-LEFT JOIN pixel_streaming_instance psi2 ON
-    psi.id = psi2.id AND
-	psi.status IN('free', 'pending', 'stopped') AND
-	psi2.status IN ('free') AND
-    psi2.region_id = psi.region_id AND
-    psi2.region_id = $1
-LEFT JOIN pixel_streaming_instance psi3 ON
-    psi.id = psi3.id AND
-	psi3.status IN ('stopped') AND
-	psi3.region_id = psi.region_id AND
-    psi3.region_id = $1
-    WHERE psi.instance_type = 'on-demand'`
-
-		row := db.QueryRow(ctx, q, regionId)
-
-		err = row.Scan(&totalAvailableInstance, &totalFreeInstance, &totalStoppedInstance)
-		if err != nil {
-			logrus.Errorf("failed to scan %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
-			return fmt.Errorf("failed to scan ps instances total %s", PSInstanceSingular)
+	// capacity is counted in slots, occupied instances still have the slots not used by their sessions,
+	// draining and cleaning instances are neither free nor available
+	q := `SELECT
+	COALESCE(SUM(GREATEST(psi.slots - COALESCE(pss.active, 0), 0)) FILTER (WHERE psi.status IN ('free', 'occupied', 'pending', 'starting', 'stopped')), 0) AS total,
+	COALESCE(SUM(GREATEST(psi.slots - COALESCE(pss.active, 0), 0)) FILTER (WHERE psi.status IN ('free', 'occupied')), 0) AS total_free,
+	COUNT(*) FILTER (WHERE psi.status = 'stopped') AS total_stopped,
+	COUNT(*) FILTER (WHERE psi.status = 'pending') AS total_pending,
+	COALESCE(SUM(psi.slots) FILTER (WHERE psi.status IN ('pending', 'starting')), 0) AS total_booting
+FROM pixel_streaming_instance psi
+	LEFT JOIN (SELECT instance_id, COUNT(*) AS active FROM pixel_streaming_sessions WHERE status = ANY($2) GROUP BY instance_id) pss ON pss.instance_id = psi.id
+WHERE psi.region_id = $1 AND psi.instance_type = 'on-demand' AND psi.release_id IS NOT DISTINCT FROM $3 AND COALESCE(psi.platform, 'windows') = $4`
+
+	row := db.QueryRow(ctx, q, regionId, ActiveSessionStatuses, pool.ReleaseId, pool.Platform)
+
+	err = row.Scan(&totalAvailableSlot, &totalFreeSlot, &totalStoppedInstance, &totalPendingInstance, &totalBootingSlot)
+	if err != nil {
+		logrus.Errorf("failed to scan %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to scan ps instances total %s", PSInstanceSingular)
+	}
+
+	cfg, err = config.LoadDefaultConfig(
+		ctx,
+		config.WithRegion(regionName),
+		config.WithClientLogMode(aws.LogRequestWithBody),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(AwsAccessKey, AwsSecretKey, "")),
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to load aws config: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+	}
+
+	var (
+		getInstanceOutput *ec2.DescribeInstancesOutput
+		ec2Client         = ec2.NewFromConfig(cfg)
+	)
+
+	resolveLaunchImage(ctx, ec2Client, regionName, &pool)
+
+	describeInstanceInput := ec2.DescribeInstancesInput{
+		DryRun: nil,
+		Filters: append(
+			pool.Filters("on-demand"),
+			NewEC2Filter("instance-state-name", PS_STATUS_RUNNING, PS_STATUS_PENDING, PS_STATUS_STOPPING, PS_STATUS_STOPPED),
+		),
+	}
+
+	getInstanceOutput, _ = GetInstances(ctx, ec2Client, &describeInstanceInput)
+
+	var reservedInstances []types.Instance
+	if getInstanceOutput != nil && len(getInstanceOutput.Reservations) > 0 {
+		for _, reservation := range getInstanceOutput.Reservations {
+			reservedInstances = append(reservedInstances, reservation.Instances...)
 		}
+	}
 
-		cfg, err = config.LoadDefaultConfig(
-			ctx,
-			config.WithRegion(regionName),
-			config.WithClientLogMode(aws.LogRequestWithBody),
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(AwsAccessKey, AwsSecretKey, "")),
-		)
+	// missing free slots are filled by starting (or resuming) stopped instances first, fresh instances are launched once none are left
+	var started bool
+	started, err = startStoppedInstances(ctx, ec2Client, regionId, pool, freeSlots-totalFreeSlot-totalBootingSlot, slots, totalStoppedInstance)
+	if err != nil || started {
+		return err
+	}
 
-		if err != nil {
-			return fmt.Errorf("failed to load aws config: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+	// only instances without sessions are stopped or terminated, as many as the excess free slots beyond the hysteresis make up once the cooldown has passed
+	var scaleDownInstanceIds []string
+	scaleDownInstanceIds, err = GetScaleDownInstanceIds(ctx, regionId, pool, "on-demand", totalFreeSlot-freeSlots, slots, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var availableOnDemandInstancesCount = CountAWSInstancesByState(reservedInstances, PS_STATUS_RUNNING, PS_STATUS_PENDING, PS_STATUS_STOPPING, PS_STATUS_STOPPED)
+	var requiredOnDemandInstancesCount = slotsToInstances(freeSlots, slots) + stoppedInstances
+	if len(scaleDownInstanceIds) > 0 {
+		logrus.Infof("scaling down %s: %v", PSInstancePlural, scaleDownInstanceIds)
+
+		var excessCount = len(scaleDownInstanceIds)
+		var stoppedCount = 0
+		if totalStoppedInstance < stoppedInstances {
+			stoppedCount = int(stoppedInstances - totalStoppedInstance)
+			if stoppedCount > excessCount {
+				stoppedCount = excessCount
+			}
 		}
+		var terminateCount = excessCount - stoppedCount
 
-		var (
-			runInstanceOutput *ec2.RunInstancesOutput
-			getInstanceOutput *ec2.DescribeInstancesOutput
-			ec2Client         = ec2.NewFromConfig(cfg)
-		)
+		var terminateInstanceIds = scaleDownInstanceIds[0:terminateCount]
+		err = ExecuteInstanceAction(ctx, ec2Client, "reconcile", INSTANCE_ACTION_TERMINATE, terminateInstanceIds)
+		if err != nil {
+			return fmt.Errorf("failed to terminate: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		}
 
-		describeInstanceInput := ec2.DescribeInstancesInput{
-			DryRun: nil,
-			Filters: []types.Filter{
-				{
-					Name:   aws.String("image-id"),
-					Values: []string{AMI_WINDOWS},
-				},
-				NewEC2Filter("tag:aws:ec2launchtemplate:id", WIN_ON_DEMAND_LAUNCH_TEMPLATE_ID),
-				NewEC2Filter("instance-state-name", PS_STATUS_RUNNING, PS_STATUS_PENDING, PS_STATUS_STOPPING, PS_STATUS_STOPPED),
-			},
+		var stopInstanceIds = scaleDownInstanceIds[terminateCount : terminateCount+stoppedCount]
+		err = ExecuteInstanceAction(ctx, ec2Client, "reconcile", INSTANCE_ACTION_STOP, stopInstanceIds)
+		if err != nil {
+			return fmt.Errorf("failed to stop on-demand instances: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
 		}
 
-		getInstanceOutput, _ = GetInstances(ctx, ec2Client, &describeInstanceInput)
+		err = markInstancesScaledDown(ctx, scaleDownInstanceIds)
+		if err != nil {
+			return err
+		}
+	} else if availableOnDemandInstancesCount > 0 && availableOnDemandInstancesCount >= requiredOnDemandInstancesCount {
+		//} else if availableOnDemandInstancesCount > 0 && availableOnDemandInstancesCount >= totalPendingInstance {
+		// update
+		var (
+			freeInstanceIds      []string
+			pendingInstanceUUIDs []uuid.UUID
+		)
 
-		var reservedInstances []types.Instance
-		if getInstanceOutput != nil && len(getInstanceOutput.Reservations) > 0 {
-			for _, reservation := range getInstanceOutput.Reservations {
-				reservedInstances = append(reservedInstances, reservation.Instances...)
-			}
+		freeInstanceIds, pendingInstanceUUIDs, err = GetInstanceIds(ctx, regionId, pool, "on-demand", "free", "pending")
+		if err != nil {
+			return err
 		}
 
-		var availableOnDemandInstancesCount = CountAWSInstancesByState(reservedInstances, PS_STATUS_RUNNING, PS_STATUS_PENDING, PS_STATUS_STOPPING, PS_STATUS_STOPPED)
-		var totalPendingInstance = totalAvailableInstance - totalFreeInstance - totalStoppedInstance
-		if totalFreeInstance > FREE_ON_DEMAND_AVAILABLE {
-			var (
-				freeInstanceIds      []string
-				pendingInstanceUUIDs []uuid.UUID
-			)
-
-			freeInstanceIds, pendingInstanceUUIDs, err = GetInstanceIds(ctx, regionId, "on-demand", "free", "pending")
-			fmt.Println("TO BE TERMINATED", freeInstanceIds, pendingInstanceUUIDs)
-
-			var stoppedCount int32 = 0
-			var terminateCount = totalFreeInstance - FREE_ON_DEMAND_AVAILABLE
-			if totalStoppedInstance < STOPPED_ON_DEMAND_AVAILABLE {
-				stoppedCount = STOPPED_ON_DEMAND_AVAILABLE - totalStoppedInstance
-				terminateCount = terminateCount - stoppedCount
-			}
+		for _, instance := range reservedInstances {
+			if instance.InstanceId != nil && instance.PublicIpAddress != nil && instance.State.Name == PS_STATUS_RUNNING {
 
-			var terminateInstanceIds = freeInstanceIds[0:terminateCount]
-			if len(terminateInstanceIds) > 0 {
-				err = TerminateInstances(ctx, ec2Client, terminateInstanceIds)
+				if slices.Contains(freeInstanceIds, *instance.InstanceId) {
+					continue
+				}
 
-				if err != nil {
-					return fmt.Errorf("failed to terminate: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
-				} else {
-					data := PixelStreamingInstanceMetadata{
-						Status: aws.String("deleted"),
-					}
-
-					for _, id := range terminateInstanceIds {
-						data.InstanceId = &id
-						err = UpdatePixelStreamingInstance(ctx, nil, data)
-						if err != nil {
-							return fmt.Errorf("failed to update running instance data: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
-						}
-					}
+				updateID, ok := launchedRowId(instance, &pendingInstanceUUIDs)
+				if !ok {
+					logrus.Warnf("no pending %s for instance %s", PSInstanceSingular, *instance.InstanceId)
+					continue
 				}
-			}
 
-			var stopInstanceIds = freeInstanceIds[terminateCount : terminateCount+stoppedCount]
-			if len(stopInstanceIds) > 0 {
-				err = StopInstances(ctx, ec2Client, stopInstanceIds)
+				err = markLaunchedInstanceFree(ctx, updateID, *instance.InstanceId, *instance.PublicIpAddress)
 				if err != nil {
-					return fmt.Errorf("failed to stop on-demand instances: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
-				} else {
-					data := PixelStreamingInstanceMetadata{
-						Status: aws.String("stopped"),
-					}
-
-					for _, id := range stopInstanceIds {
-						data.InstanceId = &id
-						err = UpdatePixelStreamingInstance(ctx, nil, data)
-						if err != nil {
-							return fmt.Errorf("failed to update running instance data: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
-						}
-					}
+					return fmt.Errorf("failed to update running instance data: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
 				}
 			}
-		} else if availableOnDemandInstancesCount > 0 && availableOnDemandInstancesCount >= (FREE_ON_DEMAND_AVAILABLE+STOPPED_ON_DEMAND_AVAILABLE) {
-			//} else if availableOnDemandInstancesCount > 0 && availableOnDemandInstancesCount >= totalPendingInstance {
-			// update
-			var (
-				freeInstanceIds      []string
-				pendingInstanceUUIDs []uuid.UUID
-			)
-
-			freeInstanceIds, pendingInstanceUUIDs, err = GetInstanceIds(ctx, regionId, "on-demand", "free", "pending")
-			for _, instance := range reservedInstances {
-				if instance.InstanceId != nil && instance.PublicIpAddress != nil && instance.State.Name == PS_STATUS_RUNNING {
-
-					if slices.Contains(freeInstanceIds, *instance.InstanceId) {
-						continue
-					}
-
-					data := PixelStreamingInstanceMetadata{
-						InstanceId: instance.InstanceId,
-						Status:     aws.String("free"),
-						Host:       instance.PublicIpAddress,
-					}
-
-					var updateID uuid.UUID
-
-					if len(pendingInstanceUUIDs) > 1 {
-						updateID, pendingInstanceUUIDs = pendingInstanceUUIDs[0], pendingInstanceUUIDs[1:]
-					} else {
-						updateID = pendingInstanceUUIDs[0]
-					}
-					err = UpdatePixelStreamingInstance(ctx, &updateID, data)
-					if err != nil {
-						return fmt.Errorf("failed to update running instance data: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
-					}
+		}
+	} else {
+		if pool.ImageId == "" {
+			logrus.Warnf("no image of release %s is available in %s yet, not launching", pool.ReleaseId, regionName)
+			return nil
+		}
+
+		var makingInstanceCount = int(slotsToInstances(freeSlots+stoppedInstances*int32(slots)-totalAvailableSlot, slots))
+		if makingInstanceCount > 0 {
+			q := `INSERT INTO pixel_streaming_instance (id, region_id, release_id, port, instance_type, status, slots, platform) VALUES (
+				$1, $2, $3, $4, $5, $6, $7, $8
+			)`
+
+			for i := 0; i < makingInstanceCount; i++ {
+				id, err1 := uuid.NewV4()
+				if err1 != nil {
+					logrus.Errorf("failed to generate uuid %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+					return fmt.Errorf("failed to set %s", PSInstanceSingular)
 				}
-			}
-		} else {
-			var makingInstanceCount = int((FREE_ON_DEMAND_AVAILABLE + STOPPED_ON_DEMAND_AVAILABLE) - totalAvailableInstance)
-			if makingInstanceCount > 0 {
-				q := `INSERT INTO pixel_streaming_instance (id, region_id, port, instance_type, status) VALUES (
-					$1, $2, $3, $4, $5                                                 
-				)`
-
-				for i := 0; i < makingInstanceCount; i++ {
-					id, err1 := uuid.NewV4()
-					if err1 != nil {
-						logrus.Errorf("failed to generate uuid %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
-						return fmt.Errorf("failed to set %s", PSInstanceSingular)
-					}
-
-					data := PixelStreamingInstanceMetadata{
-						Id:           &id,
-						RegionId:     &regionId,
-						Port:         aws.Uint16(80),
-						InstanceType: aws.String("on-demand"),
-						Status:       aws.String("pending"),
-					}
-
-					_, err = db.Exec(ctx, q, data.Id, data.RegionId, data.Port, data.InstanceType, data.Status)
-					if err != nil {
-						logrus.Errorf("failed to insert uuid %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
-						return fmt.Errorf("failed to set %s", PSInstanceSingular)
-					}
+
+				data := PixelStreamingInstanceMetadata{
+					Id:           &id,
+					RegionId:     &regionId,
+					ReleaseId:    pool.ReleaseId,
+					Port:         aws.Uint16(80),
+					InstanceType: aws.String("on-demand"),
+					Status:       aws.String("pending"),
+					Slots:        aws.Int32(int32(slots)),
+					Platform:     aws.String(pool.Platform),
 				}
-			} else if makingInstanceCount == 0 {
-				makeOnDemandInstanceInput.MaxCount = aws.Int32(totalPendingInstance)
-				//makeOnDemandInstanceInput.MaxCount = aws.Int32(totalAvailableInstance - totalFreeInstance)
 
-				runInstanceOutput, err = MakeInstance(ctx, ec2Client, makeOnDemandInstanceInput)
+				_, err = db.Exec(ctx, q, data.Id, data.RegionId, data.ReleaseId, data.Port, data.InstanceType, data.Status, data.Slots, data.Platform)
 				if err != nil {
-					return fmt.Errorf("failed to create on-demand instance: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+					logrus.Errorf("failed to insert uuid %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+					return fmt.Errorf("failed to set %s", PSInstanceSingular)
 				}
-
-				logrus.Infof("Making required free on-demand instances: %v", runInstanceOutput.Instances)
+			}
+		} else if makingInstanceCount == 0 && totalPendingInstance > 0 {
+			err = LaunchPendingInstances(ctx, ec2Client, regionId, regionName, pool, "on-demand", makeOnDemandInstanceInput)
+			if err != nil {
+				return err
 			}
 		}
 	}
@@ -578,105 +603,96 @@ WHERE
 	return nil
 }
 
-func TerminateClosedSessionsInstance(ctx context.Context) (err error) {
-	db, ok := ctx.Value("database").(*pgxpool.Pool)
-	if !ok {
-		return fmt.Errorf("unable to get database connection")
-	}
-
-	var ec2Client = ec2.NewFromConfig(cfg)
-
+// UpdateStartingInstances records the address of started instances once EC2 reports them running, the public address changes on every
+// start. They are free once their launcher reports ready too, those not ready within the starting timeout are terminated.
+func UpdateStartingInstances(ctx context.Context) (err error) {
 	var regions map[uuid.UUID]string
 	regions, err = GetRegions(ctx)
+	if err != nil {
+		return err
+	}
 
 	for regionId, regionName := range regions {
-		q := `SELECT
-    psi.instance_id, psi.region_id
-FROM
-	pixel_streaming_sessions pss
-	INNER JOIN pixel_streaming_instance psi ON psi.id = pss.instance_id AND psi.region_id = $1	
-	AND pss.status = 'closed'`
-
-		var rows pgx.Rows
-		defer func() {
-			rows.Close()
-		}()
-
-		rows, err = db.Query(ctx, q, regionId)
+		var instances []PixelStreamingInstance
+		instances, err = IndexPixelStreamingInstances(ctx, INSTANCE_STATUS_STARTING, regionId)
 		if err != nil {
-			logrus.Errorf("failed to update instance status %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
-			return fmt.Errorf("failed to update instance status %s", PSInstancePlural)
+			return err
 		}
 
-		var (
-			terminateInstanceIds []string
-		)
-
-		var instance = &PixelStreamingInstance{}
-		for rows.Next() {
-			err = rows.Scan(&instance.InstanceId, &instance.RegionId)
-			if err != nil {
-				logrus.Errorf("failed to scan %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
-				return fmt.Errorf("failed to get %s", PSInstancePlural)
+		var instanceIds []string
+		for _, instance := range instances {
+			if instance.InstanceId != nil {
+				instanceIds = append(instanceIds, *instance.InstanceId)
 			}
-
-			terminateInstanceIds = append(terminateInstanceIds, *instance.InstanceId)
 		}
 
-		cfg, err = config.LoadDefaultConfig(
-			ctx,
-			config.WithRegion(regionName),
-			config.WithClientLogMode(aws.LogRequestWithBody),
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(AwsAccessKey, AwsSecretKey, "")),
-		)
+		if len(instanceIds) == 0 {
+			continue
+		}
 
-		err = TerminateInstances(ctx, ec2Client, terminateInstanceIds)
+		ec2Client, err := NewEC2Client(ctx, regionName)
+		if err != nil {
+			return err
+		}
 
+		getInstanceOutput, err := GetInstances(ctx, ec2Client, &ec2.DescribeInstancesInput{InstanceIds: instanceIds})
 		if err != nil {
-			return fmt.Errorf("failed to terminate: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
-		} else {
-			data := PixelStreamingInstanceMetadata{
-				Status: aws.String("deleted"),
-			}
+			return fmt.Errorf("failed to describe starting instances: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		}
+
+		for _, reservation := range getInstanceOutput.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.State == nil || instance.State.Name != PS_STATUS_RUNNING || instance.PublicIpAddress == nil {
+					continue
+				}
 
-			for _, id := range terminateInstanceIds {
-				data.InstanceId = &id
-				err = UpdatePixelStreamingInstance(ctx, nil, data)
+				err = RefreshStartingHost(ctx, *instance.InstanceId, *instance.PublicIpAddress)
 				if err != nil {
-					return fmt.Errorf("failed to update running instance data: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+					return fmt.Errorf("failed to update started instance data: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
 				}
 			}
 		}
-	}
 
-	return nil
-}
+		var timedOutInstanceIds []string
+		timedOutInstanceIds, err = GetStartingTimedOutInstanceIds(ctx, regionId)
+		if err != nil {
+			return err
+		}
 
-func CountAWSInstancesByState(instances []types.Instance, states ...string) (count int32) {
-	for _, instance := range instances {
-		instanceState := string(instance.State.Name)
-		if slices.Contains(states, instanceState) {
-			count++
+		err = ExecuteInstanceAction(ctx, ec2Client, "starting-timeout", INSTANCE_ACTION_TERMINATE, timedOutInstanceIds)
+		if err != nil {
+			return err
 		}
 	}
 
-	return count
+	return FreeReadyInstances(ctx)
 }
 
-func StopInstances(ctx context.Context, api EC2API, instanceIds []string) (err error) {
-	var (
-		stopInstanceOutput *ec2.StopInstancesOutput
+// NewEC2Client makes the EC2 client for the region.
+func NewEC2Client(ctx context.Context, regionName string) (*ec2.Client, error) {
+	regionCfg, err := config.LoadDefaultConfig(
+		ctx,
+		config.WithRegion(regionName),
+		config.WithClientLogMode(aws.LogRequestWithBody),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(AwsAccessKey, AwsSecretKey, "")),
 	)
 
-	stopInstanceInput.InstanceIds = instanceIds
-	stopInstanceOutput, err = StopInstance(ctx, api, stopInstanceInput)
 	if err != nil {
-		return fmt.Errorf("failed to stop instances: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to load aws config: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
 	}
 
-	logrus.Infof("stop instance for incoming users: %v", stopInstanceOutput.StoppingInstances)
+	return ec2.NewFromConfig(regionCfg), nil
+}
 
-	return nil
+func CountAWSInstancesByState(instances []types.Instance, states ...string) (count int32) {
+	for _, instance := range instances {
+		instanceState := string(instance.State.Name)
+		if slices.Contains(states, instanceState) {
+			count++
+		}
+	}
+
+	return count
 }
 
 func TerminateInstances(ctx context.Context, api EC2API, instanceIds []string) (err error) {
@@ -684,8 +700,7 @@ func TerminateInstances(ctx context.Context, api EC2API, instanceIds []string) (
 		terminateInstanceOutput *ec2.TerminateInstancesOutput
 	)
 
-	terminateInstanceInput.InstanceIds = instanceIds
-	terminateInstanceOutput, err = TerminateInstance(ctx, api, terminateInstanceInput)
+	terminateInstanceOutput, err = TerminateInstance(ctx, api, &ec2.TerminateInstancesInput{InstanceIds: instanceIds})
 	if err != nil {
 		return fmt.Errorf("failed to terminate instances: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
 	}
@@ -695,14 +710,25 @@ func TerminateInstances(ctx context.Context, api EC2API, instanceIds []string) (
 	return nil
 }
 
-func GetInstanceIds(ctx context.Context, regionId uuid.UUID, instanceType string, statuses ...string) (freeInstanceIds []string, pendingInstanceUUIDs []uuid.UUID, err error) {
+func GetInstanceIds(ctx context.Context, regionId uuid.UUID, pool InstancePool, instanceType string, statuses ...string) (freeInstanceIds []string, pendingInstanceUUIDs []uuid.UUID, err error) {
 	db, ok := ctx.Value("database").(*pgxpool.Pool)
 	if !ok {
 		return nil, nil, fmt.Errorf("unable to get database connection")
 	}
 
 	var rows pgx.Rows
-	rows, err = db.Query(ctx, `SELECT id, instance_id, status FROM pixel_streaming_instance WHERE region_id = $1 AND instance_type = $2 AND status = ANY($3)`, regionId, instanceType, statuses)
+	// free instances of the subnets with the most instances of the pool come first, excess instances are removed from there
+	rows, err = db.Query(ctx, `SELECT id, instance_id, status FROM pixel_streaming_instance psi
+WHERE region_id = $1 AND instance_type = $2 AND status = ANY($3) AND release_id IS NOT DISTINCT FROM $4 AND COALESCE(platform, 'windows') = $5
+ORDER BY (
+	SELECT COUNT(*) FROM pixel_streaming_instance o
+	WHERE o.region_id = psi.region_id AND o.subnet_id = psi.subnet_id AND o.release_id IS NOT DISTINCT FROM psi.release_id
+		AND COALESCE(o.platform, 'windows') = $5 AND o.status <> $6
+) DESC, created_at`, regionId, instanceType, statuses, pool.ReleaseId, pool.Platform, INSTANCE_STATUS_DELETED)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return nil, nil, fmt.Errorf("failed to get %s", PSInstancePlural)
+	}
 
 	defer func() {
 		rows.Close()
@@ -721,7 +747,7 @@ func GetInstanceIds(ctx context.Context, regionId uuid.UUID, instanceType string
 
 		if *r.Status == "free" {
 			freeInstanceIds = append(freeInstanceIds, *r.InstanceId)
-		} else if *r.Status == "pending" {
+		} else if *r.Status == "pending" && r.InstanceId == nil {
 			pendingInstanceUUIDs = append(pendingInstanceUUIDs, *r.Id)
 		}
 	}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+	"veverse-pixelstreaming-operator/launcherpb"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+const (
+	SESSION_STATUS_PENDING      = "pending"
+	SESSION_STATUS_STARTING     = "starting"
+	SESSION_STATUS_RUNNING      = "running"
+	SESSION_STATUS_DISCONNECTED = "disconnected"
+	SESSION_STATUS_CLOSED       = "closed"
+
+	SESSION_END_REASON_MAX_DURATION  = "max-duration"
+	SESSION_END_REASON_IDLE          = "idle"
+	SESSION_END_REASON_START_TIMEOUT = "start-timeout"
+	SESSION_END_REASON_DISCONNECTED  = "disconnected"
+	SESSION_END_REASON_DRAINED       = "drained"
+)
+
+var (
+	PSSessionSingular = "PixelStreamingSession"
+	PSSessionPlural   = "PixelStreamingSessions"
+
+	// ActiveSessionStatuses are the statuses of sessions holding their instance
+	ActiveSessionStatuses = []string{SESSION_STATUS_STARTING, SESSION_STATUS_RUNNING, SESSION_STATUS_DISCONNECTED}
+
+	ErrSessionNotFound = errors.New("session not found")
+	ErrReconnectDenied = errors.New("session can not be reconnected")
+)
+
+// EnforceSessionTimeouts closes sessions which exceeded the limits of their app, the instance of a closed session is handled by ReleaseClosedSessionsInstance.
+func EnforceSessionTimeouts(ctx context.Context) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT id, app_id, instance_id, status, last_input_at, disconnected_at, created_at, updated_at FROM pixel_streaming_sessions WHERE status = ANY($1)`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, []string{SESSION_STATUS_PENDING, SESSION_STATUS_STARTING, SESSION_STATUS_RUNNING, SESSION_STATUS_DISCONNECTED})
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to get %s", PSSessionPlural)
+	}
+
+	var sessions []PixelStreamingSession
+	for rows.Next() {
+		var session PixelStreamingSession
+		err = rows.Scan(&session.Id, &session.AppId, &session.InstanceId, &session.Status, &session.LastInputAt, &session.DisconnectedAt, &session.CreatedAt, &session.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			logrus.Errorf("failed to scan %s @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+			return fmt.Errorf("failed to get %s", PSSessionPlural)
+		}
+
+		sessions = append(sessions, session)
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, session := range sessions {
+		reason := SessionTimeoutReason(session, Config.App(session.AppId), now)
+		if reason == "" {
+			continue
+		}
+
+		logrus.Infof("closing %s %s: %s", PSSessionSingular, session.Id, reason)
+
+		err = CloseSession(ctx, session, reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SessionTimeoutReason returns the end reason if the session exceeded one of the limits or an empty string.
+func SessionTimeoutReason(session PixelStreamingSession, limits AppConfig, now time.Time) string {
+	if session.Status == nil || session.CreatedAt == nil {
+		return ""
+	}
+
+	lastChange := *session.CreatedAt
+	if session.UpdatedAt != nil {
+		lastChange = *session.UpdatedAt
+	}
+
+	switch *session.Status {
+	case SESSION_STATUS_PENDING, SESSION_STATUS_STARTING:
+		if limits.StartTimeout.Duration > 0 && now.Sub(lastChange) > limits.StartTimeout.Duration {
+			return SESSION_END_REASON_START_TIMEOUT
+		}
+	case SESSION_STATUS_RUNNING:
+		if limits.MaxSessionDuration.Duration > 0 && now.Sub(*session.CreatedAt) > limits.MaxSessionDuration.Duration {
+			return SESSION_END_REASON_MAX_DURATION
+		}
+
+		// sessions are idle since the last input their launcher reported, or since they started running or reconnected if that is later,
+		// launchers which do not report input leave the session idle from its start
+		lastActive := lastChange
+		if session.LastInputAt != nil && session.LastInputAt.After(lastActive) {
+			lastActive = *session.LastInputAt
+		}
+
+		if limits.IdleTimeout.Duration > 0 && now.Sub(lastActive) > limits.IdleTimeout.Duration {
+			return SESSION_END_REASON_IDLE
+		}
+	case SESSION_STATUS_DISCONNECTED:
+		disconnectedAt := lastChange
+		if session.DisconnectedAt != nil {
+			disconnectedAt = *session.DisconnectedAt
+		}
+
+		if now.Sub(disconnectedAt) > limits.ReconnectGrace.Duration {
+			return SESSION_END_REASON_DISCONNECTED
+		}
+	}
+
+	return ""
+}
+
+// CloseSession marks the session as closed with the reason, the session is left untouched if its status has been changed meanwhile.
+func CloseSession(ctx context.Context, session PixelStreamingSession, reason string) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_sessions SET status = $1, end_reason = $2, reconnect_token = NULL, updated_at = now() WHERE id = $3 AND status = $4`
+
+	_, err = db.Exec(ctx, q, SESSION_STATUS_CLOSED, reason, session.Id, session.Status)
+	if err != nil {
+		logrus.Errorf("failed to close %s @ %s: %v", PSSessionSingular, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to close %s", PSSessionSingular)
+	}
+
+	// launchers connected over gRPC close the app right away, polling ones notice the closed session on their next check
+	if session.InstanceId != nil {
+		Launchers.Send(*session.InstanceId, &launcherpb.OperatorCommand{
+			Command: &launcherpb.OperatorCommand_CloseSession{CloseSession: &launcherpb.CloseSession{
+				SessionId: session.Id.String(),
+				Reason:    reason,
+			}},
+		})
+	}
+
+	return nil
+}
+
+// DisconnectSession keeps the running session and its instance for the reconnect grace window of the app,
+// the reconnect token returned to the backend when the session was created lets the same user reconnect.
+func DisconnectSession(ctx context.Context, sessionId uuid.UUID, instanceId uuid.UUID) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_sessions SET status = $1, disconnected_at = now(), updated_at = now() WHERE id = $2 AND instance_id = $3 AND status = $4`
+
+	tag, err := db.Exec(ctx, q, SESSION_STATUS_DISCONNECTED, sessionId, instanceId, SESSION_STATUS_RUNNING)
+	if err != nil {
+		logrus.Errorf("failed to disconnect %s @ %s: %v", PSSessionSingular, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to disconnect %s", PSSessionSingular)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// ReconnectSession resumes the disconnected session of the user if the token matches and the grace window has not passed.
+func ReconnectSession(ctx context.Context, request SessionReconnectRequest, now time.Time) (response SessionReconnectResponse, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return response, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT pss.app_id, pss.user_id, pss.status, pss.disconnected_at, pss.reconnect_token, COALESCE(pss.slot, 0), psi.host, psi.port
+FROM pixel_streaming_sessions pss
+	INNER JOIN pixel_streaming_instance psi ON psi.id = pss.instance_id
+WHERE pss.id = $1`
+
+	var (
+		session PixelStreamingSession
+		slot    int32
+	)
+
+	err = db.QueryRow(ctx, q, request.SessionId).Scan(
+		&session.AppId,
+		&session.UserId,
+		&session.Status,
+		&session.DisconnectedAt,
+		&session.ReconnectToken,
+		&slot,
+		&response.Host,
+		&response.Port,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return response, ErrSessionNotFound
+	} else if err != nil {
+		logrus.Errorf("failed to get %s @ %s: %v", PSSessionSingular, reflect.FunctionName(), err)
+		return response, fmt.Errorf("failed to get %s", PSSessionSingular)
+	}
+
+	if session.Status == nil || *session.Status != SESSION_STATUS_DISCONNECTED ||
+		session.UserId == nil || request.UserId == nil || *session.UserId != *request.UserId ||
+		session.ReconnectToken == nil || subtle.ConstantTimeCompare([]byte(*session.ReconnectToken), []byte(request.ReconnectToken)) != 1 ||
+		session.DisconnectedAt == nil || now.Sub(*session.DisconnectedAt) > Config.App(session.AppId).ReconnectGrace.Duration {
+		return response, ErrReconnectDenied
+	}
+
+	// the token stays valid for later disconnects of the session, it is cleared when the session closes
+	q = `UPDATE pixel_streaming_sessions SET status = $1, disconnected_at = NULL, updated_at = now() WHERE id = $2 AND status = $3 AND reconnect_token = $4`
+
+	tag, err := db.Exec(ctx, q, SESSION_STATUS_RUNNING, request.SessionId, SESSION_STATUS_DISCONNECTED, request.ReconnectToken)
+	if err != nil {
+		logrus.Errorf("failed to reconnect %s @ %s: %v", PSSessionSingular, reflect.FunctionName(), err)
+		return response, fmt.Errorf("failed to reconnect %s", PSSessionSingular)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return response, ErrReconnectDenied
+	}
+
+	// the session streams on the port of its slot
+	if response.Port != nil {
+		port := SlotPort(*response.Port, int(slot))
+		response.Port = &port
+	}
+
+	response.SessionId = request.SessionId
+	return response, nil
+}
+
+func NewReconnectToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate reconnect token: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type SessionReconnectRequest struct {
+	SessionId      *uuid.UUID `json:"sessionId"`
+	UserId         *uuid.UUID `json:"userId"`
+	ReconnectToken string     `json:"reconnectToken"`
+}
+
+type SessionReconnectResponse struct {
+	SessionId *uuid.UUID `json:"sessionId"`
+	Host      *string    `json:"host"`
+	Port      *uint16    `json:"port"`
+}
+
+func handleSessionReconnect(w http.ResponseWriter, r *http.Request) {
+	var request SessionReconnectRequest
+	if !readJson(w, r, &request) {
+		return
+	}
+
+	if request.SessionId == nil || request.UserId == nil || request.ReconnectToken == "" {
+		writeError(w, http.StatusBadRequest, "sessionId, userId and reconnectToken are required")
+		return
+	}
+
+	response, err := ReconnectSession(r.Context(), request, time.Now())
+	if errors.Is(err, ErrSessionNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if errors.Is(err, ErrReconnectDenied) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusOK, response)
+}
+
+// SessionCreateRequest is sent by the backend to allocate a session for its user, the region is picked from the hints unless it is set.
+type SessionCreateRequest struct {
+	UserId    *uuid.UUID `json:"userId"`
+	AppId     *uuid.UUID `json:"appId"`
+	WorldId   *uuid.UUID `json:"worldId,omitempty"`
+	RegionId  *uuid.UUID `json:"regionId,omitempty"`
+	ReleaseId *uuid.UUID `json:"releaseId,omitempty"` // release pool of the session, picked by the app configuration if not set
+
+	RegionHints
+}
+
+// CreateSession queues a pending session for the release pool of the app in the closest region with a free slot of the pool.
+func CreateSession(ctx context.Context, request SessionCreateRequest) (session PixelStreamingSession, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return session, fmt.Errorf("unable to get database connection")
+	}
+
+	releaseId := request.ReleaseId
+	if releaseId == nil {
+		releaseId, err = SelectRelease(ctx, request.AppId)
+		if err != nil {
+			return session, err
+		}
+	}
+
+	regionId := request.RegionId
+	if regionId == nil {
+		var selected uuid.UUID
+		selected, err = SelectRegion(ctx, releaseId, request.RegionHints)
+		if err != nil {
+			return session, err
+		}
+		regionId = &selected
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		logrus.Errorf("failed to generate uuid %s @ %s: %v", PSSessionSingular, reflect.FunctionName(), err)
+		return session, fmt.Errorf("failed to create %s", PSSessionSingular)
+	}
+
+	// the backend hands the token to its user, it is needed to reconnect once the session has been disconnected
+	token, err := NewReconnectToken()
+	if err != nil {
+		return session, err
+	}
+
+	q := `INSERT INTO pixel_streaming_sessions (id, user_id, app_id, release_id, world_id, region_id, status, reconnect_token, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now(), now())
+RETURNING id, user_id, app_id, release_id, world_id, region_id, status, reconnect_token, created_at, updated_at`
+
+	err = db.QueryRow(ctx, q, id, request.UserId, request.AppId, releaseId, request.WorldId, regionId, SESSION_STATUS_PENDING, token).Scan(
+		&session.Id,
+		&session.UserId,
+		&session.AppId,
+		&session.ReleaseId,
+		&session.WorldId,
+		&session.RegionId,
+		&session.Status,
+		&session.ReconnectToken,
+		&session.CreatedAt,
+		&session.UpdatedAt,
+	)
+
+	if err != nil {
+		logrus.Errorf("failed to insert %s @ %s: %v", PSSessionSingular, reflect.FunctionName(), err)
+		return session, fmt.Errorf("failed to create %s", PSSessionSingular)
+	}
+
+	Launchers.TriggerDispatch()
+
+	return session, nil
+}
+
+func handleSessionCreate(w http.ResponseWriter, r *http.Request) {
+	var request SessionCreateRequest
+	if !readJson(w, r, &request) {
+		return
+	}
+
+	if request.UserId == nil || request.AppId == nil {
+		writeError(w, http.StatusBadRequest, "userId and appId are required")
+		return
+	}
+
+	session, err := CreateSession(r.Context(), request)
+	if errors.Is(err, ErrNoRegion) {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusCreated, session)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+// instanceSlots is an instance with the slots taken by its active sessions.
+type instanceSlots struct {
+	Id        uuid.UUID
+	RegionId  uuid.UUID
+	ReleaseId *uuid.UUID
+	Port      *uint16
+	Slots     int
+	Active    int          // active sessions, sessions claimed by polling launchers have no slot
+	Used      map[int]bool // slots of the active sessions
+	AppIds    []uuid.UUID  // apps of the active sessions
+}
+
+// InstanceSlots returns the number of sessions an instance of the type can run at once.
+func (c *OperatorConfig) InstanceSlots(instanceType string) int {
+	if slots := c.Slots[instanceType]; slots > 0 {
+		return slots
+	}
+
+	return 1
+}
+
+// Capacity returns the number of sessions the instance can still take, apps with a slot limit lower the capacity of the whole instance.
+func (s instanceSlots) Capacity() int {
+	limit := s.Slots
+	for i := range s.AppIds {
+		if slots := Config.App(&s.AppIds[i]).Slots; slots > 0 && slots < limit {
+			limit = slots
+		}
+	}
+
+	return limit - s.Active
+}
+
+// FreeSlot returns the lowest slot index not used by an active session, -1 if all slots are used.
+func (s instanceSlots) FreeSlot() int {
+	for i := 0; i < s.Slots; i++ {
+		if !s.Used[i] {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// ExcludedAppIds returns the apps which can not share the instance with its active sessions, an empty list if none, a nil list
+// would be sent as NULL and exclude every app.
+func (s instanceSlots) ExcludedAppIds() (appIds []uuid.UUID) {
+	appIds = []uuid.UUID{}
+	for id, app := range Config.Apps {
+		if app.Slots <= 0 || app.Slots > s.Active {
+			continue
+		}
+
+		if appId, err := uuid.FromString(id); err == nil {
+			appIds = append(appIds, appId)
+		}
+	}
+
+	return appIds
+}
+
+// SlotPort returns the streaming port of the slot, slots use consecutive ports starting at the instance port.
+func SlotPort(port uint16, slot int) uint16 {
+	return port + uint16(slot)
+}
+
+// slotsToInstances rounds the slot count up to whole instances, zero and negative counts are returned as they are.
+func slotsToInstances(slotCount int32, slots int) int32 {
+	if slotCount <= 0 || slots <= 1 {
+		return slotCount
+	}
+
+	return (slotCount + int32(slots) - 1) / int32(slots)
+}
+
+// GetInstanceSlots returns the free or occupied instances out of ids with the slots used by their active sessions.
+func GetInstanceSlots(ctx context.Context, ids []uuid.UUID) (instances []instanceSlots, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT psi.id, psi.region_id, psi.release_id, psi.port, psi.slots, pss.id, pss.slot, pss.app_id
+FROM pixel_streaming_instance psi
+	LEFT JOIN pixel_streaming_sessions pss ON pss.instance_id = psi.id AND pss.status = ANY($3)
+WHERE psi.id = ANY($1) AND psi.status = ANY($2)
+ORDER BY psi.id`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, ids, []string{INSTANCE_STATUS_FREE, INSTANCE_STATUS_OCCUPIED}, ActiveSessionStatuses)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get %s", PSInstancePlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			instance  instanceSlots
+			sessionId *uuid.UUID
+			slot      *int32
+			appId     *uuid.UUID
+		)
+
+		err = rows.Scan(&instance.Id, &instance.RegionId, &instance.ReleaseId, &instance.Port, &instance.Slots, &sessionId, &slot, &appId)
+		if err != nil {
+			logrus.Errorf("failed to scan %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get %s", PSInstancePlural)
+		}
+
+		if len(instances) == 0 || instances[len(instances)-1].Id != instance.Id {
+			instance.Used = make(map[int]bool)
+			instances = append(instances, instance)
+		}
+
+		if sessionId == nil {
+			continue
+		}
+
+		// sessions without a slot were claimed by polling launchers which only know the instance port
+		last := &instances[len(instances)-1]
+		last.Active++
+		if slot != nil {
+			last.Used[int(*slot)] = true
+		} else {
+			last.Used[0] = true
+		}
+		if appId != nil {
+			last.AppIds = append(last.AppIds, *appId)
+		}
+	}
+
+	return instances, nil
+}
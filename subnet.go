@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+// SubnetsIn returns the subnets the pool launches into in the region, those of the operator if the release has none.
+func (p InstancePool) SubnetsIn(regionName string) []SubnetConfig {
+	if subnets := p.Subnets[regionName]; len(subnets) > 0 {
+		return subnets
+	}
+
+	return Config.Subnets[regionName]
+}
+
+// subnetSpread places the launches of a pool in a region in the subnets having the fewest of its instances.
+type subnetSpread struct {
+	subnets   []SubnetConfig
+	counts    map[string]int  // instances of the pool keyed by subnet id
+	exhausted map[string]bool // subnet and EC2 instance type pairs EC2 had no capacity for during this check
+}
+
+// newSubnetSpread counts the instances of the pool in each of its subnets in the region, regions without subnets launch into the
+// subnet of the launch template.
+func newSubnetSpread(ctx context.Context, regionId uuid.UUID, regionName string, pool InstancePool) (*subnetSpread, error) {
+	s := &subnetSpread{
+		subnets:   pool.SubnetsIn(regionName),
+		counts:    make(map[string]int),
+		exhausted: make(map[string]bool),
+	}
+
+	if len(s.subnets) == 0 {
+		s.subnets = []SubnetConfig{{}}
+		return s, nil
+	}
+
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT subnet_id, COUNT(*) FROM pixel_streaming_instance
+WHERE region_id = $1 AND release_id IS NOT DISTINCT FROM $2 AND COALESCE(platform, 'windows') = $3 AND status <> $4 AND subnet_id IS NOT NULL
+GROUP BY subnet_id`
+
+	var (
+		rows pgx.Rows
+		err  error
+	)
+
+	rows, err = db.Query(ctx, q, regionId, pool.ReleaseId, pool.Platform, INSTANCE_STATUS_DELETED)
+	if err != nil {
+		logrus.Errorf("failed to query %s subnets @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get %s subnets", PSInstancePlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			subnetId string
+			count    int
+		)
+
+		err = rows.Scan(&subnetId, &count)
+		if err != nil {
+			logrus.Errorf("failed to scan %s subnets @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get %s subnets", PSInstancePlural)
+		}
+
+		s.counts[subnetId] = count
+	}
+
+	return s, rows.Err()
+}
+
+// Candidates returns the subnets to launch the EC2 instance type in, the one with the fewest instances first, subnets without
+// capacity for the type are left out.
+func (s *subnetSpread) Candidates(ec2InstanceType string) (subnets []SubnetConfig) {
+	for _, subnet := range s.subnets {
+		if !s.exhausted[subnetTypeKey(subnet, ec2InstanceType)] {
+			subnets = append(subnets, subnet)
+		}
+	}
+
+	sort.SliceStable(subnets, func(i, j int) bool {
+		return s.counts[subnets[i].Id] < s.counts[subnets[j].Id]
+	})
+
+	return subnets
+}
+
+// Exhausted keeps the following launches of the check from trying the EC2 instance type in the subnet again.
+func (s *subnetSpread) Exhausted(subnet SubnetConfig, ec2InstanceType string) {
+	s.exhausted[subnetTypeKey(subnet, ec2InstanceType)] = true
+}
+
+// Launched counts an instance launched in the subnet.
+func (s *subnetSpread) Launched(subnet SubnetConfig) {
+	s.counts[subnet.Id]++
+}
+
+func subnetTypeKey(subnet SubnetConfig, ec2InstanceType string) string {
+	return subnet.Id + "/" + ec2InstanceType
+}
+
+// subnetString returns nil for the empty subnet and zone values of the launch template subnet.
+func subnetString(value string) *string {
+	if value == "" {
+		return nil
+	}
+
+	return &value
+}
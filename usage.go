@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+var (
+	UsageRecordSingular = "PixelStreamingUsage"
+	UsageRecordPlural   = "PixelStreamingUsages"
+
+	// UsageDimensions are the columns usage can be grouped by
+	UsageDimensions = []string{"day", "app", "region", "user", "release"}
+
+	ErrInvalidUsageQuery = errors.New("invalid usage query")
+
+	// SessionFailureReasons are the end reasons counted as failed sessions: the app never started or the stream was lost and not reconnected
+	SessionFailureReasons = []string{SESSION_END_REASON_START_TIMEOUT, SESSION_END_REASON_DISCONNECTED}
+)
+
+// UsageRecord summarizes a single session once it has ended.
+type UsageRecord struct {
+	SessionId     *uuid.UUID `json:"sessionId"`
+	UserId        *uuid.UUID `json:"userId,omitempty"`
+	AppId         *uuid.UUID `json:"appId,omitempty"`
+	ReleaseId     *uuid.UUID `json:"releaseId,omitempty"`
+	RegionId      *uuid.UUID `json:"regionId,omitempty"`
+	InstanceType  *string    `json:"instanceType,omitempty"`
+	StartedAt     time.Time  `json:"startedAt"`
+	EndedAt       time.Time  `json:"endedAt"`
+	Duration      int64      `json:"duration"` // seconds
+	EndReason     *string    `json:"endReason,omitempty"`
+	EstimatedCost float64    `json:"estimatedCost"` // USD
+}
+
+type UsageQuery struct {
+	From    time.Time
+	To      time.Time
+	GroupBy []string
+}
+
+type UsageAggregate struct {
+	Day           *time.Time `json:"day,omitempty"`
+	AppId         *uuid.UUID `json:"appId,omitempty"`
+	RegionId      *uuid.UUID `json:"regionId,omitempty"`
+	UserId        *uuid.UUID `json:"userId,omitempty"`
+	ReleaseId     *uuid.UUID `json:"releaseId,omitempty"`
+	Sessions      int64      `json:"sessions"`
+	Failures      int64      `json:"failures"` // sessions ended by one of SessionFailureReasons
+	Minutes       float64    `json:"minutes"`
+	EstimatedCost float64    `json:"estimatedCost"`
+}
+
+// RecordSessionUsage writes the usage records of closed sessions which have not been recorded yet.
+func RecordSessionUsage(ctx context.Context) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	// usage starts once the session is assigned to an instance, sessions which never got one have none
+	q := `SELECT pss.id, pss.user_id, pss.app_id, COALESCE(pss.release_id, psi.release_id), COALESCE(pss.region_id, psi.region_id), psi.instance_type,
+	COALESCE(psi.slots, 1), COALESCE(pss.assigned_at, pss.updated_at), pss.updated_at, pss.end_reason
+FROM pixel_streaming_sessions pss
+	LEFT JOIN pixel_streaming_instance psi ON psi.id = pss.instance_id
+	LEFT JOIN pixel_streaming_usage psu ON psu.session_id = pss.id
+WHERE pss.status = $1 AND psu.session_id IS NULL`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, SESSION_STATUS_CLOSED)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to get %s", PSSessionPlural)
+	}
+
+	var records []UsageRecord
+	for rows.Next() {
+		var (
+			record    UsageRecord
+			slots     int32
+			startedAt *time.Time
+			endedAt   *time.Time
+		)
+
+		err = rows.Scan(&record.SessionId, &record.UserId, &record.AppId, &record.ReleaseId, &record.RegionId, &record.InstanceType, &slots, &startedAt, &endedAt, &record.EndReason)
+		if err != nil {
+			rows.Close()
+			logrus.Errorf("failed to scan %s @ %s: %v", PSSessionPlural, reflect.FunctionName(), err)
+			return fmt.Errorf("failed to get %s", PSSessionPlural)
+		}
+
+		if startedAt == nil || endedAt == nil {
+			continue
+		}
+
+		record.StartedAt, record.EndedAt = *startedAt, *endedAt
+		records = append(records, NewUsageRecord(record, slots))
+	}
+	rows.Close()
+
+	q = `INSERT INTO pixel_streaming_usage (session_id, user_id, app_id, release_id, region_id, instance_type, started_at, ended_at, duration, end_reason, estimated_cost)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) ON CONFLICT (session_id) DO NOTHING`
+
+	for _, r := range records {
+		_, err = db.Exec(ctx, q, r.SessionId, r.UserId, r.AppId, r.ReleaseId, r.RegionId, r.InstanceType, r.StartedAt, r.EndedAt, r.Duration, r.EndReason, r.EstimatedCost)
+		if err != nil {
+			logrus.Errorf("failed to insert %s @ %s: %v", UsageRecordSingular, reflect.FunctionName(), err)
+			return fmt.Errorf("failed to set %s", UsageRecordSingular)
+		}
+	}
+
+	return nil
+}
+
+// NewUsageRecord fills the duration and the estimated cost of the record using the hourly price of its instance type, the sessions running
+// on the slots of the instance share its price.
+func NewUsageRecord(record UsageRecord, slots int32) UsageRecord {
+	duration := record.EndedAt.Sub(record.StartedAt)
+	if duration < 0 {
+		duration = 0
+	}
+
+	record.Duration = int64(duration / time.Second)
+	if slots < 1 {
+		slots = 1
+	}
+
+	if record.InstanceType != nil {
+		record.EstimatedCost = Config.HourlyPrices[*record.InstanceType] * duration.Hours() / float64(slots)
+	}
+
+	return record
+}
+
+// QueryUsage aggregates the usage records started within the query range by the requested dimensions.
+func QueryUsage(ctx context.Context, query UsageQuery) (aggregates []UsageAggregate, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	var (
+		columns = map[string][2]string{
+			"day":     {"date_trunc('day', started_at)", "NULL::timestamptz"},
+			"app":     {"app_id", "NULL::uuid"},
+			"region":  {"region_id", "NULL::uuid"},
+			"user":    {"user_id", "NULL::uuid"},
+			"release": {"release_id", "NULL::uuid"},
+		}
+		selects []string
+		groups  []string
+	)
+
+	for _, dimension := range query.GroupBy {
+		if _, ok := columns[dimension]; !ok {
+			return nil, fmt.Errorf("%w: unknown dimension %s", ErrInvalidUsageQuery, dimension)
+		}
+	}
+
+	for _, dimension := range UsageDimensions {
+		column := columns[dimension]
+		if slices.Contains(query.GroupBy, dimension) {
+			selects = append(selects, column[0])
+			groups = append(groups, column[0])
+		} else {
+			selects = append(selects, column[1])
+		}
+	}
+
+	q := fmt.Sprintf(`SELECT %s, COUNT(*), COUNT(*) FILTER (WHERE end_reason = ANY($3)), COALESCE(SUM(duration), 0) / 60.0, COALESCE(SUM(estimated_cost), 0)
+FROM pixel_streaming_usage
+WHERE started_at >= $1 AND started_at < $2`, strings.Join(selects, ", "))
+	if len(groups) > 0 {
+		q += fmt.Sprintf(` GROUP BY %s ORDER BY %s`, strings.Join(groups, ", "), strings.Join(groups, ", "))
+	}
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, query.From, query.To, SessionFailureReasons)
+	if err != nil {
+		logrus.Errorf("failed to query %s @ %s: %v", UsageRecordPlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get %s", UsageRecordPlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a UsageAggregate
+		err = rows.Scan(&a.Day, &a.AppId, &a.RegionId, &a.UserId, &a.ReleaseId, &a.Sessions, &a.Failures, &a.Minutes, &a.EstimatedCost)
+		if err != nil {
+			logrus.Errorf("failed to scan %s @ %s: %v", UsageRecordPlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get %s", UsageRecordPlural)
+		}
+
+		aggregates = append(aggregates, a)
+	}
+
+	return aggregates, nil
+}
+
+// ParseUsageQuery reads the range (dates as 2006-01-02, to is inclusive) and the comma separated dimensions, the range defaults to the last 30 days.
+func ParseUsageQuery(from string, to string, groupBy string, now time.Time) (query UsageQuery, err error) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	query.From = today.AddDate(0, 0, -30)
+	query.To = today.AddDate(0, 0, 1)
+
+	if from != "" {
+		query.From, err = time.Parse("2006-01-02", from)
+		if err != nil {
+			return query, fmt.Errorf("invalid from date: %v", err)
+		}
+	}
+
+	if to != "" {
+		query.To, err = time.Parse("2006-01-02", to)
+		if err != nil {
+			return query, fmt.Errorf("invalid to date: %v", err)
+		}
+		query.To = query.To.AddDate(0, 0, 1)
+	}
+
+	if groupBy != "" {
+		query.GroupBy = strings.Split(groupBy, ",")
+	}
+
+	return query, nil
+}
+
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	values := r.URL.Query()
+	query, err := ParseUsageQuery(values.Get("from"), values.Get("to"), values.Get("groupBy"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	aggregates, err := QueryUsage(r.Context(), query)
+	if errors.Is(err, ErrInvalidUsageQuery) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJson(w, http.StatusOK, aggregates)
+}
+
+// RunUsageCommand prints the aggregated usage, e.g. `veverse-pixelstreaming-operator usage -from 2023-03-01 -group-by day,app`.
+func RunUsageCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	from := flags.String("from", "", "first day (2006-01-02), defaults to 30 days ago")
+	to := flags.String("to", "", "last day (2006-01-02), defaults to today")
+	groupBy := flags.String("group-by", "day", "comma separated dimensions: "+strings.Join(UsageDimensions, ", "))
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query, err := ParseUsageQuery(*from, *to, *groupBy, time.Now())
+	if err != nil {
+		return err
+	}
+
+	aggregates, err := QueryUsage(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(append(query.GroupBy, "sessions", "failures", "failure rate", "minutes", "cost"), "\t")))
+	for _, a := range aggregates {
+		var cells []string
+		for _, dimension := range query.GroupBy {
+			cells = append(cells, a.Dimension(dimension))
+		}
+		cells = append(cells, fmt.Sprintf("%d", a.Sessions), fmt.Sprintf("%d", a.Failures), fmt.Sprintf("%.1f%%", a.FailureRate()*100), fmt.Sprintf("%.1f", a.Minutes), fmt.Sprintf("%.2f", a.EstimatedCost))
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+
+	return w.Flush()
+}
+
+// FailureRate returns the share of failed sessions, e.g. to compare a canary release with the stable one grouped by release.
+func (a UsageAggregate) FailureRate() float64 {
+	if a.Sessions == 0 {
+		return 0
+	}
+
+	return float64(a.Failures) / float64(a.Sessions)
+}
+
+// Dimension formats the value of the dimension for the output.
+func (a UsageAggregate) Dimension(dimension string) string {
+	var id *uuid.UUID
+	switch dimension {
+	case "day":
+		if a.Day != nil {
+			return a.Day.Format("2006-01-02")
+		}
+	case "app":
+		id = a.AppId
+	case "region":
+		id = a.RegionId
+	case "user":
+		id = a.UserId
+	case "release":
+		id = a.ReleaseId
+	}
+
+	if id == nil {
+		return "-"
+	}
+
+	return id.String()
+}
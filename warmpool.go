@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/smithy-go"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"time"
+	"veverse-pixelstreaming-operator/reflect"
+)
+
+const (
+	BOOT_KIND_LAUNCH = "launch" // fresh instance
+	BOOT_KIND_START  = "start"  // stopped instance booted again
+	BOOT_KIND_RESUME = "resume" // hibernated instance resumed
+)
+
+// hibernationErrorCodes are the StopInstances errors of instances which cannot hibernate, they are stopped without hibernation instead
+var hibernationErrorCodes = []string{
+	"UnsupportedHibernationConfiguration",
+	"UnsupportedOperation",
+}
+
+// StopInstances stops the instances, hibernating them if enabled, and reports whether they have been hibernated.
+func StopInstances(ctx context.Context, api EC2API, instanceIds []string) (hibernated bool, err error) {
+	stopInstanceInput := &ec2.StopInstancesInput{
+		InstanceIds: instanceIds,
+		Hibernate:   aws.Bool(Config.Hibernate),
+	}
+
+	output, err := StopInstance(ctx, api, stopInstanceInput)
+
+	var apiErr smithy.APIError
+	if Config.Hibernate && errors.As(err, &apiErr) && slices.Contains(hibernationErrorCodes, apiErr.ErrorCode()) {
+		logrus.Warnf("instances %v cannot hibernate, stopping them: %v", instanceIds, err)
+		stopInstanceInput.Hibernate = aws.Bool(false)
+		output, err = StopInstance(ctx, api, stopInstanceInput)
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed to stop instances: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+	}
+
+	logrus.Infof("stop instance for incoming users: %v", output.StoppingInstances)
+
+	return aws.ToBool(stopInstanceInput.Hibernate), nil
+}
+
+// markInstancesStopped records whether the stopped instances have been hibernated, they resume instead of booting when started.
+func markInstancesStopped(ctx context.Context, instanceIds []string, hibernated bool) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_instance SET hibernated = $1, updated_at = now() WHERE instance_id = ANY($2)`
+	_, err = db.Exec(ctx, q, hibernated, instanceIds)
+	if err != nil {
+		logrus.Errorf("failed to update stopped %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update stopped %s", PSInstancePlural)
+	}
+
+	return nil
+}
+
+// markInstancesBooting starts the boot clock of the started instances, it stops once they are free. Their address is cleared until
+// EC2 reports the new one.
+func markInstancesBooting(ctx context.Context, instanceIds []string) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_instance
+SET boot_started_at = now(), boot_kind = CASE WHEN hibernated THEN $1 ELSE $2 END, hibernated = FALSE, host = NULL, updated_at = now()
+WHERE instance_id = ANY($3)`
+
+	_, err = db.Exec(ctx, q, BOOT_KIND_RESUME, BOOT_KIND_START, instanceIds)
+	if err != nil {
+		logrus.Errorf("failed to update started %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update started %s", PSInstancePlural)
+	}
+
+	return nil
+}
+
+// GetStoppedInstanceIds returns up to count stopped instances of the pool in the region, hibernated ones first as they resume faster.
+func GetStoppedInstanceIds(ctx context.Context, regionId uuid.UUID, pool InstancePool, count int) (instanceIds []string, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	q := `SELECT instance_id FROM pixel_streaming_instance
+WHERE region_id = $1 AND instance_type = 'on-demand' AND status = $2 AND instance_id IS NOT NULL AND release_id IS NOT DISTINCT FROM $3 AND COALESCE(platform, 'windows') = $4
+ORDER BY COALESCE(hibernated, FALSE) DESC, updated_at
+LIMIT $5`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, regionId, INSTANCE_STATUS_STOPPED, pool.ReleaseId, pool.Platform, count)
+	if err != nil {
+		logrus.Errorf("failed to query stopped %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get stopped %s", PSInstancePlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var instanceId string
+		err = rows.Scan(&instanceId)
+		if err != nil {
+			logrus.Errorf("failed to scan stopped %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get stopped %s", PSInstancePlural)
+		}
+
+		instanceIds = append(instanceIds, instanceId)
+	}
+
+	return instanceIds, nil
+}
+
+// startStoppedInstances starts stopped instances of the pool for the missing free slots, true is returned if any have been started and
+// the pool launches no fresh instances in this check.
+func startStoppedInstances(ctx context.Context, api EC2API, regionId uuid.UUID, pool InstancePool, missingSlots int32, slots int, stoppedCount int32) (started bool, err error) {
+	if missingSlots <= 0 || stoppedCount <= 0 {
+		return false, nil
+	}
+
+	startCount := slotsToInstances(missingSlots, slots)
+	if startCount > stoppedCount {
+		startCount = stoppedCount
+	}
+
+	instanceIds, err := GetStoppedInstanceIds(ctx, regionId, pool, int(startCount))
+	if err != nil || len(instanceIds) == 0 {
+		return false, err
+	}
+
+	err = ExecuteInstanceAction(ctx, api, "reconcile", INSTANCE_ACTION_START, instanceIds)
+	if err != nil {
+		return false, fmt.Errorf("failed to start stopped on-demand instances: %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+	}
+
+	return true, nil
+}
+
+// MarkLauncherReady records that the launcher of a starting instance reported free, the instance is free once its address is refreshed too.
+func MarkLauncherReady(ctx context.Context, id uuid.UUID) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_instance SET launcher_ready_at = now() WHERE id = $1 AND status = $2`
+	tag, err := db.Exec(ctx, q, id, INSTANCE_STATUS_STARTING)
+	if err != nil {
+		logrus.Errorf("failed to update starting %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update starting %s", PSInstanceSingular)
+	}
+
+	// launchers of instances which are not starting report free with every heartbeat
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	return FreeReadyInstances(ctx)
+}
+
+// RefreshStartingHost records the public address of a started instance, it changes on every start.
+func RefreshStartingHost(ctx context.Context, instanceId string, host string) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_instance SET host = $1, updated_at = now() WHERE instance_id = $2 AND status = $3`
+	_, err = db.Exec(ctx, q, host, instanceId, INSTANCE_STATUS_STARTING)
+	if err != nil {
+		logrus.Errorf("failed to update starting %s @ %s: %v", PSInstanceSingular, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update starting %s", PSInstanceSingular)
+	}
+
+	return nil
+}
+
+// FreeReadyInstances marks starting instances free once they have a refreshed address and their launcher reported ready since the start.
+func FreeReadyInstances(ctx context.Context) (err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return fmt.Errorf("unable to get database connection")
+	}
+
+	q := `UPDATE pixel_streaming_instance
+SET status = $1, boot_seconds = EXTRACT(EPOCH FROM now() - boot_started_at), updated_at = now()
+WHERE status = $2 AND host IS NOT NULL AND launcher_ready_at >= boot_started_at
+RETURNING id, boot_kind, boot_seconds`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, INSTANCE_STATUS_FREE, INSTANCE_STATUS_STARTING)
+	if err != nil {
+		logrus.Errorf("failed to update ready %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return fmt.Errorf("failed to update ready %s", PSInstancePlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var instance PixelStreamingInstance
+		err = rows.Scan(&instance.Id, &instance.BootKind, &instance.BootSeconds)
+		if err != nil {
+			logrus.Errorf("failed to scan ready %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return fmt.Errorf("failed to update ready %s", PSInstancePlural)
+		}
+
+		logrus.Infof("%s %s is free after %s in %.0fs", PSInstanceSingular, instance.Id, aws.ToString(instance.BootKind), aws.ToFloat64(instance.BootSeconds))
+	}
+
+	return rows.Err()
+}
+
+// GetStartingTimedOutInstanceIds returns the starting instances of the region whose launcher has not reported ready within the starting timeout.
+func GetStartingTimedOutInstanceIds(ctx context.Context, regionId uuid.UUID) (instanceIds []string, err error) {
+	db, ok := ctx.Value("database").(*pgxpool.Pool)
+	if !ok {
+		return nil, fmt.Errorf("unable to get database connection")
+	}
+
+	timeout := Config.StartingTimeout.Duration
+	if timeout <= 0 {
+		return nil, nil
+	}
+
+	q := `SELECT instance_id FROM pixel_streaming_instance
+WHERE region_id = $1 AND status = $2 AND instance_id IS NOT NULL AND COALESCE(boot_started_at, updated_at) < $3`
+
+	var rows pgx.Rows
+	rows, err = db.Query(ctx, q, regionId, INSTANCE_STATUS_STARTING, time.Now().Add(-timeout))
+	if err != nil {
+		logrus.Errorf("failed to query starting %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+		return nil, fmt.Errorf("failed to get starting %s", PSInstancePlural)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var instanceId string
+		err = rows.Scan(&instanceId)
+		if err != nil {
+			logrus.Errorf("failed to scan starting %s @ %s: %v", PSInstancePlural, reflect.FunctionName(), err)
+			return nil, fmt.Errorf("failed to get starting %s", PSInstancePlural)
+		}
+
+		logrus.Warnf("the launcher of %s %s has not reported ready in %s", PSInstanceSingular, instanceId, timeout)
+		instanceIds = append(instanceIds, instanceId)
+	}
+
+	return instanceIds, nil
+}